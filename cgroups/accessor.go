@@ -1,111 +1,648 @@
 package cgroups
 
 import (
-	"fdocker/utils"
 	"fmt"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"os"
+	"path"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
+const DefaultRoot = "/sys/fs/cgroup"
+
+/* Containers started without --cgroup-parent are grouped under this parent */
+const DefaultParent = "fdocker"
+
+/* CPU limits are expressed as a CFS quota per period of one second */
+const cpuPeriod = 1000000
+
+/*
+	Resources holds the limits of a container as given on the command line.
+	Memory and swap are in MB, a negative value means the limit is not set.
+	For the CPU share, weight, period, quota, the blkio weight, the memory
+	reservation and kernel memory an unset limit is zero.
+*/
+type Resources struct {
+	Memory int `json:"memory"`
+	Swap   int `json:"swap"`
+
+	MemoryReservation int  `json:"memoryReservation"`
+	MemorySwappiness  int  `json:"memorySwappiness"`
+	KernelMemory      int  `json:"kernelMemory"`
+	OomKillDisable    bool `json:"oomKillDisable"`
+
+	Pids       int     `json:"pids"`
+	Cpus       float64 `json:"cpus"`
+	CpusetCpus string  `json:"cpusetCpus"`
+	CpusetMems string  `json:"cpusetMems"`
+	CpuShares  int     `json:"cpuShares"`
+	CpuWeight  int     `json:"cpuWeight"`
+	CpuPeriod  int     `json:"cpuPeriod"`
+	CpuQuota   int     `json:"cpuQuota"`
+
+	BlkioWeight     int              `json:"blkioWeight"`
+	DeviceReadBps   []ThrottleDevice `json:"deviceReadBps"`
+	DeviceWriteBps  []ThrottleDevice `json:"deviceWriteBps"`
+	DeviceReadIops  []ThrottleDevice `json:"deviceReadIops"`
+	DeviceWriteIops []ThrottleDevice `json:"deviceWriteIops"`
+
+	HugetlbLimits []HugetlbLimit `json:"hugetlbLimits"`
+
+	Devices []Device `json:"devices"`
+}
+
+func NewResources() Resources {
+	return Resources{Memory: -1, Swap: -1, MemorySwappiness: -1, Pids: -1, Cpus: -1}
+}
+
+/*
+	Validate rejects limits that can not be translated into cgroup values.
+	Unset limits are -1 (or empty for cpusets), zero is never a valid limit.
+*/
+func (r Resources) Validate() error {
+	if r.Memory == 0 || r.Memory < -1 {
+		return fmt.Errorf("invalid memory limit: %dMB", r.Memory)
+	}
+	if r.Swap < -1 {
+		return fmt.Errorf("invalid swap limit: %dMB", r.Swap)
+	}
+	if r.Swap >= 0 && r.Memory < 0 {
+		return fmt.Errorf("a swap limit requires a memory limit")
+	}
+	if r.MemoryReservation < 0 || (r.Memory > 0 && r.MemoryReservation > r.Memory) {
+		return fmt.Errorf("memory reservation %dMB must be between 0 and the memory limit", r.MemoryReservation)
+	}
+	if r.MemorySwappiness < -1 || r.MemorySwappiness > 100 {
+		return fmt.Errorf("memory swappiness %d must be between 0 and 100", r.MemorySwappiness)
+	}
+	if r.KernelMemory != 0 && r.KernelMemory < 6 {
+		return fmt.Errorf("kernel memory limit %dMB is below the minimum of 6MB", r.KernelMemory)
+	}
+	if r.Pids == 0 || r.Pids < -1 {
+		return fmt.Errorf("invalid pids limit: %d", r.Pids)
+	}
+	if r.Cpus == 0 || (r.Cpus < 0 && r.Cpus != -1) {
+		return fmt.Errorf("invalid cpus: %v", r.Cpus)
+	}
+	if r.Cpus > 0 && cpuQuota(r.Cpus) < 1000 {
+		return fmt.Errorf("cpus %v is below the minimum CFS quota of 1ms", r.Cpus)
+	}
+	if r.Cpus > 0 && (r.CpuPeriod != 0 || r.CpuQuota != 0) {
+		return fmt.Errorf("conflicting options: --cpus and --cpu-period/--cpu-quota can not both be set")
+	}
+	if r.CpuPeriod != 0 && (r.CpuPeriod < 1000 || r.CpuPeriod > 1000000) {
+		return fmt.Errorf("cpu period %d must be between 1000 and 1000000 microseconds", r.CpuPeriod)
+	}
+	if r.CpuQuota != 0 && r.CpuQuota < 1000 {
+		return fmt.Errorf("cpu quota %d must be at least 1000 microseconds", r.CpuQuota)
+	}
+	if r.CpuShares != 0 && r.CpuWeight != 0 {
+		return fmt.Errorf("conflicting options: --cpu-shares and --cpu-weight can not both be set")
+	}
+	if r.CpuShares != 0 && (r.CpuShares < 2 || r.CpuShares > 262144) {
+		return fmt.Errorf("cpu shares %d must be between 2 and 262144", r.CpuShares)
+	}
+	if r.CpuWeight != 0 && (r.CpuWeight < 1 || r.CpuWeight > 10000) {
+		return fmt.Errorf("cpu weight %d must be between 1 and 10000", r.CpuWeight)
+	}
+	if r.BlkioWeight != 0 && (r.BlkioWeight < 10 || r.BlkioWeight > 1000) {
+		return fmt.Errorf("blkio weight %d must be between 10 and 1000", r.BlkioWeight)
+	}
+	if len(r.CpusetCpus) > 0 {
+		if _, err := ParseCPUList(r.CpusetCpus); err != nil {
+			return fmt.Errorf("cpuset cpus: %v", err)
+		}
+	}
+	if len(r.CpusetMems) > 0 {
+		if _, err := ParseCPUList(r.CpusetMems); err != nil {
+			return fmt.Errorf("cpuset mems: %v", err)
+		}
+	}
+	return nil
+}
+
+func mbToBytes(mb int) int64 {
+	return int64(mb) * 1024 * 1024
+}
+
+func cpuQuota(cpus float64) int64 {
+	return int64(cpuPeriod * cpus)
+}
+
+/*
+	cpu.shares (v1, 2..262144, default 1024) and cpu.weight (v2, 1..10000,
+	default 100) express the same relative weight on different scales. The
+	conversion is the one used by runc, so a value given for one cgroup
+	version behaves alike on the other.
+*/
+func sharesToWeight(shares int) int {
+	return 1 + ((shares-2)*9999)/262142
+}
+
+func weightToShares(weight int) int {
+	return 2 + ((weight-1)*262142)/9999
+}
+
+/*
+	Stats is a snapshot of the usage counters of a container cgroup. Limits
+	are -1 when the cgroup is unlimited. CPU times are in nanoseconds,
+	PidsPeak is 0 on kernels that do not track it. Pressure stall
+	information and memory events are only available on cgroup v2 and are
+	nil otherwise.
+*/
+type Stats struct {
+	MemoryUsage    int64         `json:"memoryUsage"`
+	MemoryMaxUsage int64         `json:"memoryMaxUsage"`
+	MemoryLimit    int64         `json:"memoryLimit"`
+	OomKills       int64         `json:"oomKills"`
+	CpuUsage       int64         `json:"cpuUsage"`
+	CpuUser        int64         `json:"cpuUser"`
+	CpuSystem      int64         `json:"cpuSystem"`
+	Pids           int64         `json:"pids"`
+	PidsPeak       int64         `json:"pidsPeak"`
+	PidsLimit      int64         `json:"pidsLimit"`
+	IoReadBytes    uint64        `json:"ioReadBytes"`
+	IoWriteBytes   uint64        `json:"ioWriteBytes"`
+	IoReadOps      uint64        `json:"ioReadOps"`
+	IoWriteOps     uint64        `json:"ioWriteOps"`
+	CpuPressure    *Pressure     `json:"cpuPressure,omitempty"`
+	MemoryPressure *Pressure     `json:"memoryPressure,omitempty"`
+	IoPressure     *Pressure     `json:"ioPressure,omitempty"`
+	MemoryEvents   *MemoryEvents `json:"memoryEvents,omitempty"`
+}
+
+/*
+	Driver hides the differences between the per-controller hierarchies of
+	cgroup v1 and the unified hierarchy of cgroup v2. Groups are paths
+	relative to the cgroup root, CreateCGroups creates missing ancestors.
+	ConfigureCGroups only applies the limits that are set in res and leaves
+	the others untouched, ResetCGroups lifts the limits that are set in res
+	again. CheckSupport reports limits that have no equivalent in the
+	cgroup version.
+*/
+type Driver interface {
+	Version() int
+	CheckSupport(res Resources) error
+	CreateCGroups(group string) error
+	Exists(group string) bool
+	AddProcess(group string, pid int) error
+	RemoveCGroups(group string) error
+	ConfigureCGroups(group string, res Resources) error
+	ResetCGroups(group string, res Resources) error
+	ListCGroups(parent string) ([]string, error)
+	GetProcs(group string) ([]int, error)
+	GetStats(group string) (*Stats, error)
+	NotifyOOM(group string) (*OOMNotifier, error)
+	ConfigureDevices(group string, devices []Device) error
+}
+
+/*
+	OOMNotifier receives a value on Events for every OOM kill inside a
+	container cgroup. Events is closed once the notifier is closed.
+*/
+type OOMNotifier struct {
+	Events <-chan struct{}
+	file   *os.File
+}
+
+func (n *OOMNotifier) Close() error {
+	return n.file.Close()
+}
+
+/*
+	Accessor manages the cgroups of containers below one parent group,
+	DefaultParent unless another one is chosen with WithParent.
+*/
 type Accessor struct {
+	driver Driver
+	parent string
 }
 
 func GetAccessor() Accessor {
-	return Accessor{}
+	return NewAccessor(DefaultRoot, DetectVersion(DefaultRoot))
 }
 
-func (c Accessor) CreateCGroups(containerID string, createCGroupDirs bool) {
-	cgroups := []string{"/sys/fs/cgroup/memory/fdocker/" + containerID,
-		"/sys/fs/cgroup/pids/fdocker/" + containerID,
-		"/sys/fs/cgroup/cpu/fdocker/" + containerID}
+/*
+	Returns an accessor for the cgroup filesystem mounted at root. Any
+	directory laid out like a cgroupfs can be used as root, which lets the
+	cgroup handling be exercised without touching /sys/fs/cgroup.
+*/
+func NewAccessor(root string, version int) Accessor {
+	if version == 2 {
+		return Accessor{driver: v2Driver{root: root}, parent: DefaultParent}
+	}
+	return Accessor{driver: v1Driver{root: root}, parent: DefaultParent}
+}
 
-	if createCGroupDirs {
-		utils.MustWithMsg(utils.EnsureDirs(cgroups),
-			"Unable to create cgroup directories")
+/*
+	Returns an accessor for containers below parent, e.g. "tests/suite1".
+	The parent is always taken relative to the cgroup root, an empty parent
+	selects DefaultParent.
+*/
+func (c Accessor) WithParent(parent string) Accessor {
+	c.parent = strings.Trim(path.Clean("/"+parent), "/")
+	if len(c.parent) == 0 {
+		c.parent = DefaultParent
 	}
+	return c
+}
+
+func (c Accessor) Parent() string {
+	return c.parent
+}
+
+func (c Accessor) group(containerID string) string {
+	return path.Join(c.parent, containerID)
+}
 
-	for _, cgroupDir := range cgroups {
-		utils.MustWithMsg(ioutil.WriteFile(cgroupDir+"/notify_on_release", []byte("1"), 0700),
-			"Unable to write to cgroup notification file")
-		utils.MustWithMsg(ioutil.WriteFile(cgroupDir+"/cgroup.procs",
-			[]byte(strconv.Itoa(os.Getpid())), 0700), "Unable to write to cgroup procs file")
+/* Returns the parent group and its ancestors, the topmost one first */
+func (c Accessor) parentGroups() []string {
+	var groups []string
+	for group := c.parent; group != "."; group = path.Dir(group) {
+		groups = append([]string{group}, groups...)
 	}
+	return groups
+}
+
+/*
+	The cgroup version is detected from the filesystem mounted on root:
+	hosts running only cgroup v2 mount cgroup2 there, while v1 and hybrid
+	hosts mount a tmpfs holding one hierarchy per controller.
+*/
+func DetectVersion(root string) int {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(root, &stat); err == nil && stat.Type == unix.CGROUP2_SUPER_MAGIC {
+		return 2
+	}
+	return 1
+}
+
+func (c Accessor) Version() int {
+	return c.driver.Version()
+}
+
+/*
+	Creates the cgroups of a container along with any missing parent group.
+	Parent groups created here are recorded, so RemoveCGroups can remove
+	them again once they are empty.
+*/
+func (c Accessor) CreateCGroups(containerID string) error {
+	return updateCreatedParents(func(created map[string]bool) error {
+		for _, group := range c.parentGroups() {
+			if !c.driver.Exists(group) {
+				created[group] = true
+			}
+		}
+		return c.driver.CreateCGroups(c.group(containerID))
+	})
 }
 
-func (c Accessor) RemoveCGroups(containerID string) {
-	cgroups := []string{"/sys/fs/cgroup/memory/fdocker/" + containerID,
-		"/sys/fs/cgroup/pids/fdocker/" + containerID,
-		"/sys/fs/cgroup/cpu/fdocker/" + containerID}
+/*
+	Moves the process pid into the cgroups of a container. Processes it forks
+	afterwards are accounted to the container as well.
+*/
+func (c Accessor) AddProcess(containerID string, pid int) error {
+	return c.driver.AddProcess(c.group(containerID), pid)
+}
+
+/*
+	Removes the cgroups of a container and then, innermost first, the parent
+	groups that CreateCGroups created for it and that are now empty.
+*/
+func (c Accessor) RemoveCGroups(containerID string) error {
+	return updateCreatedParents(func(created map[string]bool) error {
+		if err := c.driver.RemoveCGroups(c.group(containerID)); err != nil {
+			return err
+		}
+		groups := c.parentGroups()
+		for i := len(groups) - 1; i >= 0; i-- {
+			if !created[groups[i]] {
+				break
+			}
+			if children, err := c.driver.ListCGroups(groups[i]); err != nil || len(children) > 0 {
+				break
+			}
+			if err := c.driver.RemoveCGroups(groups[i]); err != nil {
+				break
+			}
+			delete(created, groups[i])
+		}
+		return nil
+	})
+}
 
-	for _, cgroupDir := range cgroups {
-		utils.MustWithMsg(os.Remove(cgroupDir), "Unable to remove cgroup dir")
+/*
+	Creates the parent group if needed and applies res to it, which limits
+	all containers below it together. A parent configured this way is never
+	removed automatically.
+*/
+func (c Accessor) ConfigureParent(res Resources) error {
+	if err := c.ValidateResources(res); err != nil {
+		return err
 	}
+	return updateCreatedParents(func(created map[string]bool) error {
+		if err := c.driver.CreateCGroups(c.parent); err != nil {
+			return err
+		}
+		for _, group := range c.parentGroups() {
+			delete(created, group)
+		}
+		return c.driver.ConfigureCGroups(c.parent, res)
+	})
 }
 
-func (c Accessor) setMemoryLimit(containerID string, limitMB int, swapLimitInMB int) {
-	memFilePath := "/sys/fs/cgroup/memory/fdocker/" + containerID +
-		"/memory.limit_in_bytes"
-	swapFilePath := "/sys/fs/cgroup/memory/fdocker/" + containerID +
-		"/memory.memsw.limit_in_bytes"
-	utils.MustWithMsg(ioutil.WriteFile(memFilePath,
-		[]byte(strconv.Itoa(limitMB*1024*1024)), 0644),
-		"Unable to write memory limit")
+/*
+	Validates res and checks that every limit set in it can be applied with
+	the cgroup version and the CPUs of the host.
+*/
+func (c Accessor) ValidateResources(res Resources) error {
+	if err := res.Validate(); err != nil {
+		return err
+	}
+	if res.Cpus > float64(runtime.NumCPU()) {
+		return fmt.Errorf("cpus %.2f exceeds the %d available cpus", res.Cpus, runtime.NumCPU())
+	}
+	return c.driver.CheckSupport(res)
+}
 
-	/*
-		memory.memsw.limit_in_bytes contains the total amount of memory the
-		control group can consume: this includes both swap and RAM.
-		If if memory.limit_in_bytes is specified but memory.memsw.limit_in_bytes
-		is left untouched, processes in the control group will continue to
-		consume swap space.
-	*/
-	if swapLimitInMB >= 0 {
-		utils.MustWithMsg(ioutil.WriteFile(swapFilePath,
-			[]byte(strconv.Itoa((limitMB*1024*1024)+(swapLimitInMB*1024*1024))),
-			0644), "Unable to write memory limit")
+func (c Accessor) ConfigureCGroups(containerID string, res Resources) error {
+	if err := c.ValidateResources(res); err != nil {
+		return err
 	}
+	if err := c.driver.ConfigureCGroups(c.group(containerID), res); err != nil {
+		return err
+	}
+	return c.driver.ConfigureDevices(c.group(containerID), append(DefaultDevices(), res.Devices...))
+}
+
+func (c Accessor) ListCGroups() ([]string, error) {
+	return c.driver.ListCGroups(c.parent)
+}
+
+func (c Accessor) GetProcs(containerID string) ([]int, error) {
+	return c.driver.GetProcs(c.group(containerID))
+}
+
+func (c Accessor) GetStats(containerID string) (*Stats, error) {
+	return c.driver.GetStats(c.group(containerID))
 }
 
-func (c Accessor) setCpuLimit(containerID string, limit float64) {
-	cfsPeriodPath := "/sys/fs/cgroup/cpu/fdocker/" + containerID +
-		"/cpu.cfs_period_us"
-	cfsQuotaPath := "/sys/fs/cgroup/cpu/fdocker/" + containerID +
-		"/cpu.cfs_quota_us"
+func (c Accessor) NotifyOOM(containerID string) (*OOMNotifier, error) {
+	return c.driver.NotifyOOM(c.group(containerID))
+}
 
-	if limit > float64(runtime.NumCPU()) {
-		fmt.Printf("Ignoring attempt to set CPU quota to great than number of available CPUs")
-		return
+/*
+	Checks new limits of a running container against what it currently uses,
+	so that an update does not make the kernel reclaim or kill right away.
+*/
+func (c Accessor) ValidateUpdate(containerID string, res Resources) error {
+	if err := c.ValidateResources(res); err != nil {
+		return err
+	}
+	if len(res.CpusetCpus) > 0 {
+		cpus, err := ParseCPUList(res.CpusetCpus)
+		if err != nil {
+			return err
+		}
+		for _, cpu := range cpus {
+			if cpu >= runtime.NumCPU() {
+				return fmt.Errorf("cpu %d does not exist, %d cpus are available", cpu, runtime.NumCPU())
+			}
+		}
+	}
+	stats, err := c.driver.GetStats(c.group(containerID))
+	if err != nil {
+		return err
+	}
+	if res.Memory > 0 && int64(res.Memory)*1024*1024 < stats.MemoryUsage {
+		return fmt.Errorf("memory limit %dMB is below current usage of %dMB",
+			res.Memory, stats.MemoryUsage/1024/1024)
+	}
+	if res.Pids > 0 && int64(res.Pids) < stats.Pids {
+		return fmt.Errorf("pids limit %d is below the %d processes currently running",
+			res.Pids, stats.Pids)
+	}
+	return nil
+}
+
+/*
+	Rewrites the cgroup files of a running container for every limit that
+	differs between old and res. Limits that res no longer sets are reset
+	first, a new limit may depend on it, like the v1 memory limit that can
+	not exceed the memsw limit.
+*/
+func (c Accessor) UpdateCGroups(containerID string, old Resources, res Resources) error {
+	if err := c.driver.ResetCGroups(c.group(containerID), resetLimits(old, res)); err != nil {
+		return err
+	}
+	changed := NewResources()
+	if res.Memory != old.Memory || res.Swap != old.Swap {
+		changed.Memory, changed.Swap = res.Memory, res.Swap
+	}
+	if res.MemoryReservation != old.MemoryReservation {
+		changed.MemoryReservation = res.MemoryReservation
+	}
+	if res.MemorySwappiness != old.MemorySwappiness {
+		changed.MemorySwappiness = res.MemorySwappiness
+	}
+	if res.KernelMemory != old.KernelMemory {
+		changed.KernelMemory = res.KernelMemory
+	}
+	if res.OomKillDisable != old.OomKillDisable {
+		changed.OomKillDisable = res.OomKillDisable
+	}
+	if res.Cpus != old.Cpus {
+		changed.Cpus = res.Cpus
+	}
+	if res.Pids != old.Pids {
+		changed.Pids = res.Pids
+	}
+	if res.CpusetCpus != old.CpusetCpus {
+		changed.CpusetCpus = res.CpusetCpus
+	}
+	if res.CpusetMems != old.CpusetMems {
+		changed.CpusetMems = res.CpusetMems
+	}
+	if res.CpuShares != old.CpuShares || res.CpuWeight != old.CpuWeight {
+		changed.CpuShares, changed.CpuWeight = res.CpuShares, res.CpuWeight
 	}
+	if res.CpuPeriod != old.CpuPeriod || res.CpuQuota != old.CpuQuota {
+		changed.CpuPeriod, changed.CpuQuota = res.CpuPeriod, res.CpuQuota
+	}
+	if res.BlkioWeight != old.BlkioWeight {
+		changed.BlkioWeight = res.BlkioWeight
+	}
+	/* io.max holds all four limits of a device on one line, so they are rewritten together */
+	if !equalThrottleDevices(res.DeviceReadBps, old.DeviceReadBps) ||
+		!equalThrottleDevices(res.DeviceWriteBps, old.DeviceWriteBps) ||
+		!equalThrottleDevices(res.DeviceReadIops, old.DeviceReadIops) ||
+		!equalThrottleDevices(res.DeviceWriteIops, old.DeviceWriteIops) {
+		changed.DeviceReadBps, changed.DeviceWriteBps = res.DeviceReadBps, res.DeviceWriteBps
+		changed.DeviceReadIops, changed.DeviceWriteIops = res.DeviceReadIops, res.DeviceWriteIops
+	}
+	if !equalHugetlbLimits(res.HugetlbLimits, old.HugetlbLimits) {
+		changed.HugetlbLimits = res.HugetlbLimits
+	}
+	return c.driver.ConfigureCGroups(c.group(containerID), changed)
+}
 
-	utils.MustWithMsg(ioutil.WriteFile(cfsPeriodPath,
-		[]byte(strconv.Itoa(1000000)), 0644),
-		"Unable to write CFS period")
+/*
+	Returns the limits that are set in old but not in res with their old
+	values. Throttled devices and huge page sizes are compared one by one,
+	so dropping one of several entries resets just that one.
+*/
+func resetLimits(old Resources, res Resources) Resources {
+	reset := NewResources()
+	if old.Memory > 0 && res.Memory < 0 {
+		reset.Memory = old.Memory
+	}
+	if old.Swap >= 0 && res.Swap < 0 {
+		reset.Swap = old.Swap
+	}
+	if old.MemoryReservation > 0 && res.MemoryReservation == 0 {
+		reset.MemoryReservation = old.MemoryReservation
+	}
+	if old.MemorySwappiness >= 0 && res.MemorySwappiness < 0 {
+		reset.MemorySwappiness = old.MemorySwappiness
+	}
+	if old.KernelMemory > 0 && res.KernelMemory == 0 {
+		reset.KernelMemory = old.KernelMemory
+	}
+	reset.OomKillDisable = old.OomKillDisable && !res.OomKillDisable
+	if old.Cpus > 0 && res.Cpus < 0 {
+		reset.Cpus = old.Cpus
+	}
+	if old.Pids > 0 && res.Pids < 0 {
+		reset.Pids = old.Pids
+	}
+	if len(old.CpusetCpus) > 0 && len(res.CpusetCpus) == 0 {
+		reset.CpusetCpus = old.CpusetCpus
+	}
+	if len(old.CpusetMems) > 0 && len(res.CpusetMems) == 0 {
+		reset.CpusetMems = old.CpusetMems
+	}
+	if res.CpuShares == 0 && res.CpuWeight == 0 {
+		reset.CpuShares, reset.CpuWeight = old.CpuShares, old.CpuWeight
+	}
+	if old.CpuPeriod > 0 && res.CpuPeriod == 0 {
+		reset.CpuPeriod = old.CpuPeriod
+	}
+	if old.CpuQuota > 0 && res.CpuQuota == 0 {
+		reset.CpuQuota = old.CpuQuota
+	}
+	if old.BlkioWeight > 0 && res.BlkioWeight == 0 {
+		reset.BlkioWeight = old.BlkioWeight
+	}
+	reset.DeviceReadBps = droppedThrottleDevices(old.DeviceReadBps, res.DeviceReadBps)
+	reset.DeviceWriteBps = droppedThrottleDevices(old.DeviceWriteBps, res.DeviceWriteBps)
+	reset.DeviceReadIops = droppedThrottleDevices(old.DeviceReadIops, res.DeviceReadIops)
+	reset.DeviceWriteIops = droppedThrottleDevices(old.DeviceWriteIops, res.DeviceWriteIops)
+	reset.HugetlbLimits = droppedHugetlbLimits(old.HugetlbLimits, res.HugetlbLimits)
+	return reset
+}
 
-	utils.MustWithMsg(ioutil.WriteFile(cfsQuotaPath,
-		[]byte(strconv.Itoa(int(1000000*limit))), 0644),
-		"Unable to write CFS period")
+/*
+	Parses a cpu or memory node list in the cpuset format, e.g. "0-3,6,8-9".
+*/
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid list: %s", list)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return nil, fmt.Errorf("invalid list: %s", list)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
 
+func writeFile(filePath string, value string) error {
+	return ioutil.WriteFile(filePath, []byte(value), 0644)
 }
 
-func (c Accessor) setPidsLimit(containerID string, limit int) {
-	maxProcsPath := "/sys/fs/cgroup/pids/fdocker/" + containerID +
-		"/pids.max"
+func readString(filePath string) (string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	utils.MustWithMsg(ioutil.WriteFile(maxProcsPath,
-		[]byte(strconv.Itoa(limit)), 0644),
-		"Unable to write pids limit")
+/*
+	Reads a single number from a cgroup file. "max", as used by cgroup v2 and
+	pids.max for unlimited values, is returned as -1.
+*/
+func readInt(filePath string) (int64, error) {
+	value, err := readString(filePath)
+	if err != nil {
+		return 0, err
+	}
+	if value == "max" {
+		return -1, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
 
+func readProcs(filePath string) ([]int, error) {
+	value, err := readString(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var procs []int
+	for _, line := range strings.Fields(value) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		procs = append(procs, pid)
+	}
+	return procs, nil
 }
 
-func (c Accessor) ConfigureCGroups(containerID string, mem int, swap int, pids int, cpus float64) {
-	if mem > 0 {
-		c.setMemoryLimit(containerID, mem, swap)
+/*
+	Parses flat keyed files such as cpu.stat and memory.events, which hold
+	one "key value" pair per line.
+*/
+func readKeyedFile(filePath string) (map[string]int64, error) {
+	value, err := readString(filePath)
+	if err != nil {
+		return nil, err
 	}
-	if cpus > 0 {
-		c.setCpuLimit(containerID, cpus)
+	values := make(map[string]int64)
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			values[fields[0]] = n
+		}
+	}
+	return values, nil
+}
+
+func listDirs(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
-	if pids > 0 {
-		c.setPidsLimit(containerID, pids)
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
 	}
+	return dirs, nil
 }
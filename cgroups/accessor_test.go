@@ -0,0 +1,141 @@
+package cgroups
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testContainerID = "0123456789ab"
+
+/*
+	Returns an accessor on a fake cgroupfs in a temporary directory, with
+	the groups of testContainerID already created, as CreateCGroups would
+	need the real parent bookkeeping below /var/run.
+*/
+func newTestAccessor(t *testing.T, version int) (Accessor, string) {
+	root := t.TempDir()
+	c := NewAccessor(root, version)
+	var dirs []string
+	if version == 2 {
+		dirs = []string{path.Join(root, c.group(testContainerID))}
+	} else {
+		for _, subsystem := range []string{"memory", "pids", "cpu", "cpuset", "blkio", "devices"} {
+			dirs = append(dirs, path.Join(root, subsystem, c.group(testContainerID)))
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, root
+}
+
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("%s was not written: %v", filePath, err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func writeTestFile(t *testing.T, filePath string, value string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filePath, []byte(value), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFile(t *testing.T, filePath string, expected string) {
+	t.Helper()
+	if actual := readTestFile(t, filePath); actual != expected {
+		t.Errorf("%s: expected %q, got %q", path.Base(filePath), expected, actual)
+	}
+}
+
+func assertNoFile(t *testing.T, filePath string) {
+	t.Helper()
+	if _, err := os.Stat(filePath); err == nil {
+		t.Errorf("%s was written although its limit is not set", path.Base(filePath))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := NewResources()
+	valid.Memory, valid.Swap, valid.Cpus, valid.Pids = 512, 256, 0.5, 100
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid limits were rejected: %v", err)
+	}
+	if err := NewResources().Validate(); err != nil {
+		t.Fatalf("unset limits were rejected: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(res *Resources)
+	}{
+		{"zero memory", func(res *Resources) { res.Memory = 0 }},
+		{"negative memory", func(res *Resources) { res.Memory = -2 }},
+		{"negative swap", func(res *Resources) { res.Swap = -2 }},
+		{"swap without memory", func(res *Resources) { res.Swap = 256 }},
+		{"reservation above memory", func(res *Resources) { res.Memory, res.MemoryReservation = 256, 512 }},
+		{"swappiness above 100", func(res *Resources) { res.MemorySwappiness = 101 }},
+		{"kernel memory below 6MB", func(res *Resources) { res.KernelMemory = 4 }},
+		{"zero pids", func(res *Resources) { res.Pids = 0 }},
+		{"zero cpus", func(res *Resources) { res.Cpus = 0 }},
+		{"negative cpus", func(res *Resources) { res.Cpus = -0.5 }},
+		{"cpus below 1ms quota", func(res *Resources) { res.Cpus = 0.0005 }},
+		{"cpus with cpu quota", func(res *Resources) { res.Cpus, res.CpuQuota = 0.5, 50000 }},
+		{"cpu period too short", func(res *Resources) { res.CpuPeriod = 999 }},
+		{"cpu period too long", func(res *Resources) { res.CpuPeriod = 1000001 }},
+		{"cpu quota too short", func(res *Resources) { res.CpuQuota = 999 }},
+		{"cpu shares with weight", func(res *Resources) { res.CpuShares, res.CpuWeight = 1024, 100 }},
+		{"cpu shares too low", func(res *Resources) { res.CpuShares = 1 }},
+		{"cpu weight too high", func(res *Resources) { res.CpuWeight = 10001 }},
+		{"blkio weight too low", func(res *Resources) { res.BlkioWeight = 5 }},
+		{"invalid cpuset", func(res *Resources) { res.CpusetCpus = "3-1" }},
+		{"invalid memory nodes", func(res *Resources) { res.CpusetMems = "a" }},
+	}
+	for _, test := range tests {
+		res := NewResources()
+		test.modify(&res)
+		if err := res.Validate(); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestConfigureRejectsCpusAboveHost(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	res := NewResources()
+	res.Cpus = 100000
+	if err := c.ConfigureCGroups(testContainerID, res); err == nil {
+		t.Fatal("expected an error for more cpus than the host has")
+	}
+	assertNoFile(t, path.Join(root, "cpu", c.group(testContainerID), "cpu.cfs_quota_us"))
+}
+
+func TestParseCPUList(t *testing.T) {
+	cpus, err := ParseCPUList("0-2,5, 7-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{0, 1, 2, 5, 7, 8}
+	if len(cpus) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, cpus)
+	}
+	for n := range expected {
+		if cpus[n] != expected[n] {
+			t.Fatalf("expected %v, got %v", expected, cpus)
+		}
+	}
+	for _, list := range []string{"", "-1", "2-1", "0,x"} {
+		if _, err := ParseCPUList(list); err == nil {
+			t.Errorf("%q: expected an error", list)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package cgroups
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+)
+
+/*
+	ThrottleDevice is a per-device IO limit given as <device-path>:<rate>.
+	The device path is resolved to its major:minor numbers when the flag is
+	parsed, as that is what the blkio and io controllers expect.
+*/
+type ThrottleDevice struct {
+	Path  string `json:"path"`
+	Major uint32 `json:"major"`
+	Minor uint32 `json:"minor"`
+	Rate  uint64 `json:"rate"`
+}
+
+func (t ThrottleDevice) String() string {
+	return t.Path + ":" + strconv.FormatUint(t.Rate, 10)
+}
+
+func resolveBlockDevice(devicePath string) (uint32, uint32, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(devicePath, &stat); err != nil {
+		return 0, 0, err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", devicePath)
+	}
+	return unix.Major(stat.Rdev), unix.Minor(stat.Rdev), nil
+}
+
+/*
+	Parses sizes such as 512, 100k, 10mb or 1G into bytes. Units are binary,
+	like docker's --device-read-bps.
+*/
+func parseSize(size string) (uint64, error) {
+	lower := strings.TrimSuffix(strings.ToLower(size), "b")
+	multiplier := uint64(1)
+	if len(lower) > 0 {
+		switch lower[len(lower)-1] {
+		case 'k':
+			multiplier = 1024
+		case 'm':
+			multiplier = 1024 * 1024
+		case 'g':
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier > 1 {
+			lower = lower[:len(lower)-1]
+		}
+	}
+	value, err := strconv.ParseUint(lower, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return value * multiplier, nil
+}
+
+/*
+	throttleDevicesValue implements pflag.Value for the repeatable
+	--device-{read,write}-{bps,iops} flags. The first occurrence on the
+	command line replaces the defaults instead of adding to them.
+*/
+type throttleDevicesValue struct {
+	devices *[]ThrottleDevice
+	isBytes bool
+	changed bool
+}
+
+func (t *throttleDevicesValue) Set(value string) error {
+	sep := strings.LastIndex(value, ":")
+	if sep <= 0 {
+		return fmt.Errorf("invalid device limit %s, expected <device-path>:<rate>", value)
+	}
+	devicePath, rateStr := value[:sep], value[sep+1:]
+	var rate uint64
+	var err error
+	if t.isBytes {
+		rate, err = parseSize(rateStr)
+	} else {
+		rate, err = strconv.ParseUint(rateStr, 10, 64)
+	}
+	if err != nil || rate == 0 {
+		return fmt.Errorf("invalid rate in device limit %s", value)
+	}
+	major, minor, err := resolveBlockDevice(devicePath)
+	if err != nil {
+		return err
+	}
+	if !t.changed {
+		*t.devices = nil
+		t.changed = true
+	}
+	*t.devices = append(*t.devices, ThrottleDevice{Path: devicePath, Major: major, Minor: minor, Rate: rate})
+	return nil
+}
+
+func (t *throttleDevicesValue) String() string {
+	var values []string
+	for _, device := range *t.devices {
+		values = append(values, device.String())
+	}
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+func (t *throttleDevicesValue) Type() string {
+	return "list"
+}
+
+/*
+	--blkio-weight uses the v1 scale of 10..1000, io.weight of cgroup v2
+	ranges from 1 to 10000. Same conversion as runc.
+*/
+func blkioWeightToIOWeight(weight int) int {
+	return 1 + (weight-10)*9999/990
+}
+
+func equalThrottleDevices(a []ThrottleDevice, b []ThrottleDevice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* Returns the devices of old that have no limit in res */
+func droppedThrottleDevices(old []ThrottleDevice, res []ThrottleDevice) []ThrottleDevice {
+	var dropped []ThrottleDevice
+	for _, device := range old {
+		found := false
+		for _, other := range res {
+			if other.Major == device.Major && other.Minor == device.Minor {
+				found = true
+			}
+		}
+		if !found {
+			dropped = append(dropped, device)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,146 @@
+package cgroups
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+)
+
+const allDevicePermissions = "rwm"
+
+/*
+	Device is an entry of the device allow-list of a container. Entries with
+	a host path are also made available inside the container at
+	PathInContainer, the others only grant access, e.g. to the pseudo
+	terminals created by devpts. Major and Minor are -1 for any number.
+*/
+type Device struct {
+	PathOnHost      string `json:"pathOnHost,omitempty"`
+	PathInContainer string `json:"pathInContainer,omitempty"`
+	Permissions     string `json:"permissions"`
+	Type            string `json:"type"`
+	Major           int64  `json:"major"`
+	Minor           int64  `json:"minor"`
+}
+
+/*
+	Returns the devices every container gets, the same set docker allows by
+	default apart from mknod, which is of no use in a user namespace.
+*/
+func DefaultDevices() []Device {
+	return []Device{
+		{PathOnHost: "/dev/null", PathInContainer: "/dev/null", Permissions: "rwm", Type: "c", Major: 1, Minor: 3},
+		{PathOnHost: "/dev/zero", PathInContainer: "/dev/zero", Permissions: "rwm", Type: "c", Major: 1, Minor: 5},
+		{PathOnHost: "/dev/full", PathInContainer: "/dev/full", Permissions: "rwm", Type: "c", Major: 1, Minor: 7},
+		{PathOnHost: "/dev/random", PathInContainer: "/dev/random", Permissions: "rwm", Type: "c", Major: 1, Minor: 8},
+		{PathOnHost: "/dev/urandom", PathInContainer: "/dev/urandom", Permissions: "rwm", Type: "c", Major: 1, Minor: 9},
+		{PathOnHost: "/dev/tty", PathInContainer: "/dev/tty", Permissions: "rwm", Type: "c", Major: 5, Minor: 0},
+		/* /dev/ptmx and /dev/pts/* of the devpts instance mounted in the container */
+		{Permissions: "rwm", Type: "c", Major: 5, Minor: 2},
+		{Permissions: "rwm", Type: "c", Major: 136, Minor: -1},
+	}
+}
+
+func (d Device) String() string {
+	if d.PathInContainer == d.PathOnHost && d.Permissions == allDevicePermissions {
+		return d.PathOnHost
+	}
+	return d.PathOnHost + ":" + d.PathInContainer + ":" + d.Permissions
+}
+
+/*
+	Formats the device as an entry of the v1 devices.allow file,
+	e.g. "c 136:* rwm".
+*/
+func (d Device) rule() string {
+	return fmt.Sprintf("%s %s:%s %s", d.Type, deviceNumber(d.Major), deviceNumber(d.Minor), d.Permissions)
+}
+
+func deviceNumber(number int64) string {
+	if number < 0 {
+		return "*"
+	}
+	return strconv.FormatInt(number, 10)
+}
+
+func validDevicePermissions(permissions string) bool {
+	if len(permissions) == 0 {
+		return false
+	}
+	for _, p := range permissions {
+		if !strings.ContainsRune(allDevicePermissions, p) || strings.Count(permissions, string(p)) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Parses a --device value of the form <host-path>[:<container-path>][:<permissions>].
+	The host path has to be a character or block device, its type and
+	numbers are looked up right away.
+*/
+func ParseDevice(value string) (Device, error) {
+	parts := strings.Split(value, ":")
+	device := Device{PathOnHost: parts[0], PathInContainer: parts[0], Permissions: allDevicePermissions}
+	switch len(parts) {
+	case 1:
+	case 2:
+		if validDevicePermissions(parts[1]) {
+			device.Permissions = parts[1]
+		} else {
+			device.PathInContainer = parts[1]
+		}
+	case 3:
+		device.PathInContainer, device.Permissions = parts[1], parts[2]
+	default:
+		return device, fmt.Errorf("invalid device %s, expected <host-path>[:<container-path>][:<permissions>]", value)
+	}
+	if !validDevicePermissions(device.Permissions) {
+		return device, fmt.Errorf("invalid permissions %s for device %s, expected a combination of r, w and m",
+			device.Permissions, device.PathOnHost)
+	}
+	if !strings.HasPrefix(device.PathInContainer, "/") {
+		return device, fmt.Errorf("container path %s of device %s must be absolute", device.PathInContainer, device.PathOnHost)
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(device.PathOnHost, &stat); err != nil {
+		return device, err
+	}
+	switch stat.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		device.Type = "c"
+	case unix.S_IFBLK:
+		device.Type = "b"
+	default:
+		return device, fmt.Errorf("%s is not a device", device.PathOnHost)
+	}
+	device.Major, device.Minor = int64(unix.Major(stat.Rdev)), int64(unix.Minor(stat.Rdev))
+	return device, nil
+}
+
+type devicesValue struct {
+	devices *[]Device
+}
+
+func (v *devicesValue) Set(value string) error {
+	device, err := ParseDevice(value)
+	if err != nil {
+		return err
+	}
+	*v.devices = append(*v.devices, device)
+	return nil
+}
+
+func (v *devicesValue) String() string {
+	var values []string
+	for _, device := range *v.devices {
+		values = append(values, device.String())
+	}
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+func (v *devicesValue) Type() string {
+	return "list"
+}
@@ -0,0 +1,198 @@
+package cgroups
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"unsafe"
+)
+
+/*
+	cgroup v2 has no devices controller, device access is checked by an eBPF
+	program of type BPF_PROG_TYPE_CGROUP_DEVICE attached to the cgroup. The
+	program is called with a struct bpf_cgroup_dev_ctx
+		u32 access_type	device type in the lower, access in the upper 16 bits
+		u32 major
+		u32 minor
+	and returns 1 to allow the access and 0 to deny it.
+*/
+type bpfInsn struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func bpfLoadWord(dst uint8, src uint8, off int16) bpfInsn {
+	return bpfInsn{code: unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W, regs: dst | src<<4, off: off}
+}
+
+func bpfAlu32Imm(op uint8, dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: unix.BPF_ALU | unix.BPF_K | op, regs: dst, imm: imm}
+}
+
+func bpfMovReg(dst uint8, src uint8) bpfInsn {
+	return bpfInsn{code: unix.BPF_ALU64 | unix.BPF_X | unix.BPF_MOV, regs: dst | src<<4}
+}
+
+func bpfMovImm(dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: unix.BPF_ALU64 | unix.BPF_K | unix.BPF_MOV, regs: dst, imm: imm}
+}
+
+func bpfJneImm(dst uint8, imm int32) bpfInsn {
+	return bpfInsn{code: unix.BPF_JMP | unix.BPF_K | unix.BPF_JNE, regs: dst, imm: imm}
+}
+
+func bpfJneReg(dst uint8, src uint8) bpfInsn {
+	return bpfInsn{code: unix.BPF_JMP | unix.BPF_X | unix.BPF_JNE, regs: dst | src<<4}
+}
+
+func bpfExit() bpfInsn {
+	return bpfInsn{code: unix.BPF_JMP | unix.BPF_EXIT}
+}
+
+/*
+	Builds a program that allows exactly the given devices. The context is
+	unpacked into r2 (type), r3 (access), r4 (major) and r5 (minor), then
+	every device gets a block of checks that jumps to the next block on a
+	mismatch and returns 1 when all of them pass.
+*/
+func deviceFilterProgram(devices []Device) []bpfInsn {
+	prog := []bpfInsn{
+		bpfLoadWord(2, 1, 0),
+		bpfAlu32Imm(unix.BPF_AND, 2, 0xFFFF),
+		bpfLoadWord(3, 1, 0),
+		bpfAlu32Imm(unix.BPF_RSH, 3, 16),
+		bpfLoadWord(4, 1, 4),
+		bpfLoadWord(5, 1, 8),
+	}
+	for _, device := range devices {
+		var block []bpfInsn
+		switch device.Type {
+		case "c":
+			block = append(block, bpfJneImm(2, unix.BPF_DEVCG_DEV_CHAR))
+		case "b":
+			block = append(block, bpfJneImm(2, unix.BPF_DEVCG_DEV_BLOCK))
+		}
+		if access := deviceAccess(device.Permissions); access != deviceAccess(allDevicePermissions) {
+			/* Every requested kind of access has to be allowed */
+			block = append(block,
+				bpfMovReg(1, 3),
+				bpfAlu32Imm(unix.BPF_AND, 1, access),
+				bpfJneReg(1, 3))
+		}
+		if device.Major >= 0 {
+			block = append(block, bpfJneImm(4, int32(device.Major)))
+		}
+		if device.Minor >= 0 {
+			block = append(block, bpfJneImm(5, int32(device.Minor)))
+		}
+		block = append(block, bpfMovImm(0, 1), bpfExit())
+		for i := range block {
+			if block[i].code&0x07 == unix.BPF_JMP && block[i].code&0xf0 == unix.BPF_JNE {
+				block[i].off = int16(len(block) - i - 1)
+			}
+		}
+		prog = append(prog, block...)
+	}
+	return append(prog, bpfMovImm(0, 0), bpfExit())
+}
+
+func deviceAccess(permissions string) int32 {
+	var access int32
+	for _, p := range permissions {
+		switch p {
+		case 'r':
+			access |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			access |= unix.BPF_DEVCG_ACC_WRITE
+		case 'm':
+			access |= unix.BPF_DEVCG_ACC_MKNOD
+		}
+	}
+	return access
+}
+
+/* Leading part of union bpf_attr as used by BPF_PROG_LOAD */
+type bpfProgLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [unix.BPF_OBJ_NAME_LEN]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+/* Part of union bpf_attr as used by BPF_PROG_ATTACH */
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+/*
+	Loads the device filter for devices and attaches it to cgroupDir. The
+	program stays attached for the lifetime of the cgroup, its fd is not
+	needed afterwards.
+*/
+func attachDeviceFilter(cgroupDir string, devices []Device) error {
+	insns := deviceFilterProgram(devices)
+	license := []byte("GPL\x00")
+	log := make([]byte, 64*1024)
+	loadAttr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_CGROUP_DEVICE,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(log)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	copy(loadAttr.progName[:], "fdocker_devices")
+	progFd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&loadAttr), unsafe.Sizeof(loadAttr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return fmt.Errorf("loading device filter: %v: %s", err, cString(log))
+	}
+	defer unix.Close(progFd)
+
+	dirFd, err := unix.Open(cgroupDir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirFd)
+	attachAttr := bpfProgAttachAttr{
+		targetFd:    uint32(dirFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+	}
+	if _, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attachAttr), unsafe.Sizeof(attachAttr)); err != nil {
+		return fmt.Errorf("attaching device filter: %v", err)
+	}
+	return nil
+}
+
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,44 @@
+package cgroups
+
+import flag "github.com/spf13/pflag"
+
+/*
+	Registers the resource limit flags shared by run and update.
+	The current values of res are used as defaults and are overwritten when
+	fs is parsed.
+*/
+func AddResourceFlags(fs *flag.FlagSet, res *Resources) {
+	fs.IntVar(&res.Memory, "mem", res.Memory, "Max RAM to allow in MB")
+	fs.IntVar(&res.Swap, "swap", res.Swap, "Max swap to allow in MB")
+	fs.IntVar(&res.MemoryReservation, "memory-reservation", res.MemoryReservation, "Memory soft limit in MB")
+	fs.IntVar(&res.MemorySwappiness, "memory-swappiness", res.MemorySwappiness, "Tune container memory swappiness (0 to 100)")
+	fs.IntVar(&res.KernelMemory, "kernel-memory", res.KernelMemory, "Kernel memory limit in MB (cgroup v1 only)")
+	fs.BoolVar(&res.OomKillDisable, "oom-kill-disable", res.OomKillDisable, "Disable OOM Killer (cgroup v1 only)")
+	fs.IntVar(&res.Pids, "pids", res.Pids, "Number of max processes to allow")
+	fs.Float64Var(&res.Cpus, "cpus", res.Cpus, "Number of CPU cores to restrict to")
+	fs.StringVar(&res.CpusetCpus, "cpuset-cpus", res.CpusetCpus, "CPUs in which to allow execution (0-3, 0,1)")
+	fs.StringVar(&res.CpusetMems, "cpuset-mems", res.CpusetMems, "Memory nodes in which to allow execution (0-3, 0,1)")
+	fs.IntVar(&res.CpuShares, "cpu-shares", res.CpuShares, "CPU shares (relative weight, 2-262144)")
+	fs.IntVar(&res.CpuWeight, "cpu-weight", res.CpuWeight, "CPU weight (relative weight, 1-10000)")
+	fs.IntVar(&res.CpuPeriod, "cpu-period", res.CpuPeriod, "Limit CPU CFS period in microseconds")
+	fs.IntVar(&res.CpuQuota, "cpu-quota", res.CpuQuota, "Limit CPU CFS quota in microseconds")
+	fs.IntVar(&res.BlkioWeight, "blkio-weight", res.BlkioWeight, "Block IO relative weight (10-1000)")
+	fs.Var(&throttleDevicesValue{devices: &res.DeviceReadBps, isBytes: true}, "device-read-bps",
+		"Limit read rate from a device (/dev/sda:10mb)")
+	fs.Var(&throttleDevicesValue{devices: &res.DeviceWriteBps, isBytes: true}, "device-write-bps",
+		"Limit write rate to a device (/dev/sda:10mb)")
+	fs.Var(&throttleDevicesValue{devices: &res.DeviceReadIops}, "device-read-iops",
+		"Limit read rate from a device in IO per second (/dev/sda:1000)")
+	fs.Var(&throttleDevicesValue{devices: &res.DeviceWriteIops}, "device-write-iops",
+		"Limit write rate to a device in IO per second (/dev/sda:1000)")
+	fs.Var(&hugetlbValue{limits: &res.HugetlbLimits}, "hugetlb", "Limit huge pages of a page size (2MB=1G)")
+}
+
+/*
+	Registers --device, which only run accepts: the devices of a container
+	are fixed once it has been created.
+*/
+func AddDeviceFlag(fs *flag.FlagSet, res *Resources) {
+	fs.Var(&devicesValue{devices: &res.Devices}, "device",
+		"Add a host device to the container (/dev/fuse[:/dev/fuse][:rwm])")
+}
@@ -0,0 +1,108 @@
+package cgroups
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	HugetlbLimit caps the huge pages of one size a container may use, given
+	as <page-size>=<limit>, e.g. 2MB=1G. PageSize is kept in the notation
+	of the hugetlb controller files (64KB, 2MB, 1GB).
+*/
+type HugetlbLimit struct {
+	PageSize string `json:"pageSize"`
+	Limit    uint64 `json:"limit"`
+}
+
+func (h HugetlbLimit) String() string {
+	return h.PageSize + "=" + strconv.FormatUint(h.Limit, 10)
+}
+
+func normalizePageSize(pageSize string) (string, error) {
+	upper := strings.TrimSuffix(strings.ToUpper(pageSize), "B")
+	if len(upper) < 2 {
+		return "", fmt.Errorf("invalid huge page size: %s", pageSize)
+	}
+	unit := upper[len(upper)-1:]
+	if unit != "K" && unit != "M" && unit != "G" {
+		return "", fmt.Errorf("invalid huge page size: %s", pageSize)
+	}
+	if n, err := strconv.ParseUint(upper[:len(upper)-1], 10, 64); err != nil || n == 0 {
+		return "", fmt.Errorf("invalid huge page size: %s", pageSize)
+	}
+	return upper + "B", nil
+}
+
+/*
+	hugetlbValue implements pflag.Value for the repeatable --hugetlb flag.
+	Like the device throttling flags, the first occurrence replaces the
+	defaults.
+*/
+type hugetlbValue struct {
+	limits  *[]HugetlbLimit
+	changed bool
+}
+
+func (h *hugetlbValue) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid hugetlb limit %s, expected <page-size>=<limit>", value)
+	}
+	pageSize, err := normalizePageSize(parts[0])
+	if err != nil {
+		return err
+	}
+	limit, err := parseSize(parts[1])
+	if err != nil {
+		return err
+	}
+	if !h.changed {
+		*h.limits = nil
+		h.changed = true
+	}
+	*h.limits = append(*h.limits, HugetlbLimit{PageSize: pageSize, Limit: limit})
+	return nil
+}
+
+func (h *hugetlbValue) String() string {
+	var values []string
+	for _, limit := range *h.limits {
+		values = append(values, limit.String())
+	}
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+func (h *hugetlbValue) Type() string {
+	return "list"
+}
+
+func equalHugetlbLimits(a []HugetlbLimit, b []HugetlbLimit) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/* Returns the limits of old whose page size has no limit in res */
+func droppedHugetlbLimits(old []HugetlbLimit, res []HugetlbLimit) []HugetlbLimit {
+	var dropped []HugetlbLimit
+	for _, limit := range old {
+		found := false
+		for _, other := range res {
+			if other.PageSize == limit.PageSize {
+				found = true
+			}
+		}
+		if !found {
+			dropped = append(dropped, limit)
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,59 @@
+package cgroups
+
+import (
+	"encoding/json"
+	"fdocker/workdirs"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+/*
+	Runs fn with the set of parent groups f-docker created on its own and
+	saves the set afterwards. The file is locked meanwhile, so containers
+	started and stopped at the same time below a shared parent do not
+	remove the parent under each other.
+*/
+func updateCreatedParents(fn func(created map[string]bool) error) error {
+	f, err := os.OpenFile(workdirs.CGroupParentsPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var groups []string
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &groups); err != nil {
+			return err
+		}
+	}
+	created := make(map[string]bool)
+	for _, group := range groups {
+		created[group] = true
+	}
+
+	fnErr := fn(created)
+
+	groups = groups[:0]
+	for group := range created {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	if data, err = json.Marshal(groups); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return fnErr
+}
@@ -0,0 +1,99 @@
+package cgroups
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+	PressureAvg is one line of a pressure stall information file: the share
+	of wall time in percent that tasks were stalled, averaged over 10, 60
+	and 300 seconds, and the total stall time in microseconds.
+*/
+type PressureAvg struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	Total  uint64  `json:"total"`
+}
+
+/*
+	Pressure is the content of cpu.pressure, memory.pressure or io.pressure.
+	"some" counts time in which at least one task was stalled, "full" time
+	in which all of them were.
+*/
+type Pressure struct {
+	Some PressureAvg `json:"some"`
+	Full PressureAvg `json:"full"`
+}
+
+/*
+	MemoryEvents are the counters of memory.events: how often the cgroup
+	went below memory.low, was throttled at memory.high, hit memory.max, ran
+	out of memory and had a process OOM-killed.
+*/
+type MemoryEvents struct {
+	Low     int64 `json:"low"`
+	High    int64 `json:"high"`
+	Max     int64 `json:"max"`
+	Oom     int64 `json:"oom"`
+	OomKill int64 `json:"oomKill"`
+}
+
+/*
+	Returns nil without an error when the kernel does not provide pressure
+	stall information, either because it lacks CONFIG_PSI or because it was
+	booted with psi=0.
+*/
+func readPressure(filePath string) (*Pressure, error) {
+	value, err := readString(filePath)
+	if os.IsNotExist(err) || isNotSupported(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pressure := &Pressure{}
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 {
+			continue
+		}
+		var avg *PressureAvg
+		switch fields[0] {
+		case "some":
+			avg = &pressure.Some
+		case "full":
+			avg = &pressure.Full
+		default:
+			continue
+		}
+		for _, field := range fields[1:] {
+			keyValue := strings.SplitN(field, "=", 2)
+			if len(keyValue) != 2 {
+				return nil, fmt.Errorf("invalid pressure line in %s: %s", filePath, line)
+			}
+			switch keyValue[0] {
+			case "avg10":
+				avg.Avg10, err = strconv.ParseFloat(keyValue[1], 64)
+			case "avg60":
+				avg.Avg60, err = strconv.ParseFloat(keyValue[1], 64)
+			case "avg300":
+				avg.Avg300, err = strconv.ParseFloat(keyValue[1], 64)
+			case "total":
+				avg.Total, err = strconv.ParseUint(keyValue[1], 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid pressure line in %s: %s", filePath, line)
+			}
+		}
+	}
+	return pressure, nil
+}
+
+func isNotSupported(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == unix.EOPNOTSUPP
+}
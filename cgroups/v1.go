@@ -0,0 +1,538 @@
+package cgroups
+
+import (
+	"fdocker/utils"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+	v1Driver manages one <cgroup-parent>/<container-id> group in each of the
+	memory, pids, cpu, cpuset, blkio and devices hierarchies, and in the
+	hugetlb hierarchy where the host has one. Groups are given as paths
+	relative to the root of the hierarchies.
+*/
+type v1Driver struct {
+	root string
+}
+
+/* Values at or above this in memory.limit_in_bytes mean "no limit" */
+const v1UnlimitedMemory = int64(1) << 62
+
+/* The values of a new group, which ResetCGroups restores */
+const (
+	v1DefaultCpuShares   = 1024
+	v1DefaultCfsPeriod   = 100000
+	v1DefaultBlkioWeight = 500
+	v1DefaultBfqWeight   = 100
+)
+
+func (d v1Driver) Version() int {
+	return 1
+}
+
+func (d v1Driver) CheckSupport(res Resources) error {
+	return nil
+}
+
+func (d v1Driver) getCGroupDir(subsystem string, group string) string {
+	return path.Join(d.root, subsystem, group)
+}
+
+func (d v1Driver) getCGroupDirs(group string) []string {
+	dirs := []string{d.getCGroupDir("memory", group),
+		d.getCGroupDir("pids", group),
+		d.getCGroupDir("cpu", group),
+		d.getCGroupDir("cpuset", group),
+		d.getCGroupDir("blkio", group),
+		d.getCGroupDir("devices", group)}
+	/* hugetlb is only mounted on hosts whose kernel supports huge pages */
+	if _, err := os.Stat(path.Join(d.root, "hugetlb")); err == nil {
+		dirs = append(dirs, d.getCGroupDir("hugetlb", group))
+	}
+	return dirs
+}
+
+func (d v1Driver) CreateCGroups(group string) error {
+	cgroups := d.getCGroupDirs(group)
+	if err := utils.EnsureDirs(cgroups); err != nil {
+		return err
+	}
+	/* A cpuset cgroup refuses new tasks until its cpus and mems are populated */
+	if err := d.inheritCpuset(d.getCGroupDir("cpuset", group)); err != nil {
+		return err
+	}
+	for _, cgroupDir := range cgroups {
+		if err := writeFile(cgroupDir+"/notify_on_release", "1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) Exists(group string) bool {
+	_, err := os.Stat(d.getCGroupDir("cpu", group))
+	return err == nil
+}
+
+func (d v1Driver) AddProcess(group string, pid int) error {
+	for _, cgroupDir := range d.getCGroupDirs(group) {
+		if err := writeFile(cgroupDir+"/cgroup.procs", strconv.Itoa(pid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	Registers an eventfd for memory.oom_control through cgroup.event_control.
+	The eventfd is signalled whenever the cgroup hits its limit and once more
+	when the cgroup is removed, so the oom_kill counter tells the cases apart.
+	Kernels before 4.13 lack the counter, every event is taken as a kill then.
+*/
+func (d v1Driver) NotifyOOM(group string) (*OOMNotifier, error) {
+	memDir := d.getCGroupDir("memory", group)
+	oomControl, err := os.Open(memDir + "/memory.oom_control")
+	if err != nil {
+		return nil, err
+	}
+	defer oomControl.Close()
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	eventFile := os.NewFile(uintptr(efd), "oom-eventfd")
+	eventControl := fmt.Sprintf("%d %d", efd, oomControl.Fd())
+	if err := writeFile(memDir+"/cgroup.event_control", eventControl); err != nil {
+		eventFile.Close()
+		return nil, err
+	}
+
+	events := make(chan struct{})
+	go func() {
+		defer close(events)
+		buf := make([]byte, 8)
+		var kills int64
+		for {
+			if _, err := eventFile.Read(buf); err != nil {
+				return
+			}
+			values, err := readKeyedFile(memDir + "/memory.oom_control")
+			if err != nil {
+				return
+			}
+			if current, ok := values["oom_kill"]; !ok || current > kills {
+				kills = current
+				events <- struct{}{}
+			}
+		}
+	}()
+	return &OOMNotifier{Events: events, file: eventFile}, nil
+}
+
+func (d v1Driver) inheritCpuset(cgroupDir string) error {
+	parentDir := path.Dir(cgroupDir)
+	if parentDir != path.Join(d.root, "cpuset") {
+		if err := d.inheritCpuset(parentDir); err != nil {
+			return err
+		}
+	}
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		current, err := readString(path.Join(cgroupDir, file))
+		if err != nil {
+			return err
+		}
+		if len(current) > 0 {
+			continue
+		}
+		parent, err := readString(path.Join(parentDir, file))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(path.Join(cgroupDir, file), parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) RemoveCGroups(group string) error {
+	for _, cgroupDir := range d.getCGroupDirs(group) {
+		if err := os.Remove(cgroupDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) ConfigureCGroups(group string, res Resources) error {
+	if res.Memory > 0 {
+		if err := d.setMemoryLimit(group, res.Memory, res.Swap); err != nil {
+			return err
+		}
+	}
+	if err := d.setMemoryControls(group, res); err != nil {
+		return err
+	}
+	if res.Cpus > 0 {
+		if err := d.setCpuLimit(group, res.Cpus); err != nil {
+			return err
+		}
+	}
+	if res.Pids > 0 {
+		if err := writeFile(d.getCGroupDir("pids", group)+"/pids.max", strconv.Itoa(res.Pids)); err != nil {
+			return err
+		}
+	}
+	if len(res.CpusetCpus) > 0 {
+		if err := writeFile(d.getCGroupDir("cpuset", group)+"/cpuset.cpus", res.CpusetCpus); err != nil {
+			return err
+		}
+	}
+	if len(res.CpusetMems) > 0 {
+		if err := writeFile(d.getCGroupDir("cpuset", group)+"/cpuset.mems", res.CpusetMems); err != nil {
+			return err
+		}
+	}
+	shares := res.CpuShares
+	if res.CpuWeight > 0 {
+		shares = weightToShares(res.CpuWeight)
+	}
+	if shares > 0 {
+		if err := writeFile(d.getCGroupDir("cpu", group)+"/cpu.shares", strconv.Itoa(shares)); err != nil {
+			return err
+		}
+	}
+	if res.CpuPeriod > 0 {
+		if err := writeFile(d.getCGroupDir("cpu", group)+"/cpu.cfs_period_us", strconv.Itoa(res.CpuPeriod)); err != nil {
+			return err
+		}
+	}
+	if res.CpuQuota > 0 {
+		if err := writeFile(d.getCGroupDir("cpu", group)+"/cpu.cfs_quota_us", strconv.Itoa(res.CpuQuota)); err != nil {
+			return err
+		}
+	}
+	for _, limit := range res.HugetlbLimits {
+		limitFile := d.getCGroupDir("hugetlb", group) + "/hugetlb." + limit.PageSize + ".limit_in_bytes"
+		if err := writeFile(limitFile, strconv.FormatUint(limit.Limit, 10)); err != nil {
+			return err
+		}
+	}
+	return d.setBlkioLimits(group, res)
+}
+
+/*
+	Lifts the limits set in res: byte limits and the CFS quota take -1,
+	pids.max takes "max", weights and the CFS period go back to the kernel
+	defaults, and the cpuset and swappiness to the values of the parent.
+	memsw goes first, the memory limit must not exceed it.
+*/
+func (d v1Driver) ResetCGroups(group string, res Resources) error {
+	memDir := d.getCGroupDir("memory", group)
+	cpuDir := d.getCGroupDir("cpu", group)
+	cpusetDir := d.getCGroupDir("cpuset", group)
+	var files, values []string
+	reset := func(file string, value string) {
+		files = append(files, file)
+		values = append(values, value)
+	}
+	if res.Swap >= 0 {
+		reset(memDir+"/memory.memsw.limit_in_bytes", "-1")
+	}
+	if res.Memory > 0 {
+		reset(memDir+"/memory.limit_in_bytes", "-1")
+	}
+	if res.MemoryReservation > 0 {
+		reset(memDir+"/memory.soft_limit_in_bytes", "-1")
+	}
+	if res.KernelMemory > 0 {
+		reset(memDir+"/memory.kmem.limit_in_bytes", "-1")
+	}
+	if res.OomKillDisable {
+		reset(memDir+"/memory.oom_control", "0")
+	}
+	if res.Cpus > 0 || res.CpuQuota > 0 {
+		reset(cpuDir+"/cpu.cfs_quota_us", "-1")
+	}
+	if res.Cpus > 0 || res.CpuPeriod > 0 {
+		reset(cpuDir+"/cpu.cfs_period_us", strconv.Itoa(v1DefaultCfsPeriod))
+	}
+	if res.CpuShares > 0 || res.CpuWeight > 0 {
+		reset(cpuDir+"/cpu.shares", strconv.Itoa(v1DefaultCpuShares))
+	}
+	if res.Pids > 0 {
+		reset(d.getCGroupDir("pids", group)+"/pids.max", "max")
+	}
+	inherited := []struct {
+		set  bool
+		file string
+	}{
+		{res.MemorySwappiness >= 0, path.Join(memDir, "memory.swappiness")},
+		{len(res.CpusetCpus) > 0, path.Join(cpusetDir, "cpuset.cpus")},
+		{len(res.CpusetMems) > 0, path.Join(cpusetDir, "cpuset.mems")},
+	}
+	for _, file := range inherited {
+		if !file.set {
+			continue
+		}
+		parent, err := readString(path.Join(path.Dir(path.Dir(file.file)), path.Base(file.file)))
+		if err != nil {
+			return err
+		}
+		reset(file.file, parent)
+	}
+	for _, limit := range res.HugetlbLimits {
+		reset(d.getCGroupDir("hugetlb", group)+"/hugetlb."+limit.PageSize+".limit_in_bytes", "-1")
+	}
+	for n, file := range files {
+		if err := writeFile(file, values[n]); err != nil {
+			return err
+		}
+	}
+	return d.resetBlkioLimits(group, res)
+}
+
+/*
+	A new devices cgroup inherits the rules of its parent, which usually
+	allow everything, so they are all revoked before devices are allowed.
+*/
+func (d v1Driver) ConfigureDevices(group string, devices []Device) error {
+	devicesDir := d.getCGroupDir("devices", group)
+	if err := writeFile(devicesDir+"/devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := writeFile(devicesDir+"/devices.allow", device.rule()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) setBlkioLimits(group string, res Resources) error {
+	blkioDir := d.getCGroupDir("blkio", group)
+	if res.BlkioWeight > 0 {
+		/* Kernels using the BFQ scheduler only provide blkio.bfq.weight */
+		weightFile := blkioDir + "/blkio.weight"
+		if _, err := os.Stat(weightFile); os.IsNotExist(err) {
+			weightFile = blkioDir + "/blkio.bfq.weight"
+		}
+		if err := writeFile(weightFile, strconv.Itoa(res.BlkioWeight)); err != nil {
+			return err
+		}
+	}
+	throttles := map[string][]ThrottleDevice{
+		"blkio.throttle.read_bps_device":   res.DeviceReadBps,
+		"blkio.throttle.write_bps_device":  res.DeviceWriteBps,
+		"blkio.throttle.read_iops_device":  res.DeviceReadIops,
+		"blkio.throttle.write_iops_device": res.DeviceWriteIops,
+	}
+	for file, devices := range throttles {
+		/* Every write sets the limit of a single device */
+		for _, device := range devices {
+			limit := fmt.Sprintf("%d:%d %d", device.Major, device.Minor, device.Rate)
+			if err := writeFile(path.Join(blkioDir, file), limit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* A rate of 0 removes the limit of a device */
+func (d v1Driver) resetBlkioLimits(group string, res Resources) error {
+	blkioDir := d.getCGroupDir("blkio", group)
+	if res.BlkioWeight > 0 {
+		weightFile, weight := blkioDir+"/blkio.weight", v1DefaultBlkioWeight
+		if _, err := os.Stat(weightFile); os.IsNotExist(err) {
+			weightFile, weight = blkioDir+"/blkio.bfq.weight", v1DefaultBfqWeight
+		}
+		if err := writeFile(weightFile, strconv.Itoa(weight)); err != nil {
+			return err
+		}
+	}
+	throttles := map[string][]ThrottleDevice{
+		"blkio.throttle.read_bps_device":   res.DeviceReadBps,
+		"blkio.throttle.write_bps_device":  res.DeviceWriteBps,
+		"blkio.throttle.read_iops_device":  res.DeviceReadIops,
+		"blkio.throttle.write_iops_device": res.DeviceWriteIops,
+	}
+	for file, devices := range throttles {
+		for _, device := range devices {
+			if err := writeFile(path.Join(blkioDir, file), fmt.Sprintf("%d:%d 0", device.Major, device.Minor)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) setMemoryLimit(group string, limitMB int, swapLimitInMB int) error {
+	memFilePath := d.getCGroupDir("memory", group) + "/memory.limit_in_bytes"
+	swapFilePath := d.getCGroupDir("memory", group) + "/memory.memsw.limit_in_bytes"
+	memLimit := mbToBytes(limitMB)
+
+	/*
+		memory.memsw.limit_in_bytes contains the total amount of memory the
+		control group can consume: this includes both swap and RAM.
+		If if memory.limit_in_bytes is specified but memory.memsw.limit_in_bytes
+		is left untouched, processes in the control group will continue to
+		consume swap space.
+	*/
+	if swapLimitInMB < 0 {
+		return writeFile(memFilePath, strconv.FormatInt(memLimit, 10))
+	}
+	swapLimit := memLimit + mbToBytes(swapLimitInMB)
+
+	/*
+		The kernel rejects a memory limit above the memsw limit, so when
+		limits are raised on a live cgroup memsw has to be written first.
+	*/
+	files := []string{memFilePath, swapFilePath}
+	values := []int64{memLimit, swapLimit}
+	if current, err := readInt(swapFilePath); err == nil && swapLimit > current {
+		files[0], files[1] = files[1], files[0]
+		values[0], values[1] = values[1], values[0]
+	}
+	for i, file := range files {
+		if err := writeFile(file, strconv.FormatInt(values[i], 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) setMemoryControls(group string, res Resources) error {
+	memDir := d.getCGroupDir("memory", group)
+	if res.MemoryReservation > 0 {
+		if err := writeFile(memDir+"/memory.soft_limit_in_bytes", strconv.FormatInt(mbToBytes(res.MemoryReservation), 10)); err != nil {
+			return err
+		}
+	}
+	if res.MemorySwappiness >= 0 {
+		if err := writeFile(memDir+"/memory.swappiness", strconv.Itoa(res.MemorySwappiness)); err != nil {
+			return err
+		}
+	}
+	if res.KernelMemory > 0 {
+		/* Kernel memory accounting was removed in Linux 6.x */
+		kmemFile := memDir + "/memory.kmem.limit_in_bytes"
+		if _, err := os.Stat(kmemFile); os.IsNotExist(err) {
+			return fmt.Errorf("--kernel-memory is not supported by this kernel")
+		}
+		if err := writeFile(kmemFile, strconv.FormatInt(mbToBytes(res.KernelMemory), 10)); err != nil {
+			return fmt.Errorf("unable to set kernel memory limit: %v", err)
+		}
+	}
+	if res.OomKillDisable {
+		if err := writeFile(memDir+"/memory.oom_control", "1"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v1Driver) setCpuLimit(group string, limit float64) error {
+	cfsPeriodPath := d.getCGroupDir("cpu", group) + "/cpu.cfs_period_us"
+	cfsQuotaPath := d.getCGroupDir("cpu", group) + "/cpu.cfs_quota_us"
+
+	if err := writeFile(cfsPeriodPath, strconv.Itoa(cpuPeriod)); err != nil {
+		return err
+	}
+	return writeFile(cfsQuotaPath, strconv.FormatInt(cpuQuota(limit), 10))
+}
+
+func (d v1Driver) ListCGroups(parent string) ([]string, error) {
+	dirs, err := listDirs(d.getCGroupDir("cpu", parent))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return dirs, err
+}
+
+func (d v1Driver) GetProcs(group string) ([]int, error) {
+	return readProcs(d.getCGroupDir("cpu", group) + "/cgroup.procs")
+}
+
+func (d v1Driver) GetStats(group string) (*Stats, error) {
+	var err error
+	stats := &Stats{}
+	memDir := d.getCGroupDir("memory", group)
+	if stats.MemoryUsage, err = readInt(memDir + "/memory.usage_in_bytes"); err != nil {
+		return nil, err
+	}
+	if stats.MemoryLimit, err = readInt(memDir + "/memory.limit_in_bytes"); err != nil {
+		return nil, err
+	}
+	if stats.MemoryLimit >= v1UnlimitedMemory {
+		stats.MemoryLimit = -1
+	}
+	if stats.MemoryMaxUsage, err = readInt(memDir + "/memory.max_usage_in_bytes"); err != nil {
+		return nil, err
+	}
+	oomControl, err := readKeyedFile(memDir + "/memory.oom_control")
+	if err != nil {
+		return nil, err
+	}
+	stats.OomKills = oomControl["oom_kill"]
+	/* cpu and cpuacct are co-mounted, so the usage is found in the cpu hierarchy */
+	if stats.CpuUsage, err = readInt(d.getCGroupDir("cpu", group) + "/cpuacct.usage"); err != nil {
+		return nil, err
+	}
+	/* cpuacct.stat counts in USER_HZ, which is 100 on all architectures Linux runs on */
+	cpuacctStat, err := readKeyedFile(d.getCGroupDir("cpu", group) + "/cpuacct.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.CpuUser = cpuacctStat["user"] * (1000000000 / 100)
+	stats.CpuSystem = cpuacctStat["system"] * (1000000000 / 100)
+	pidsDir := d.getCGroupDir("pids", group)
+	if stats.Pids, err = readInt(pidsDir + "/pids.current"); err != nil {
+		return nil, err
+	}
+	if stats.PidsLimit, err = readInt(pidsDir + "/pids.max"); err != nil {
+		return nil, err
+	}
+	blkioDir := d.getCGroupDir("blkio", group)
+	if stats.IoReadBytes, stats.IoWriteBytes, err = readBlkioStat(blkioDir + "/blkio.throttle.io_service_bytes"); err != nil {
+		return nil, err
+	}
+	if stats.IoReadOps, stats.IoWriteOps, err = readBlkioStat(blkioDir + "/blkio.throttle.io_serviced"); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+/*
+	Sums up the per-device "MAJ:MIN Read|Write|... value" lines of a blkio
+	stat file into read and write totals.
+*/
+func readBlkioStat(filePath string) (uint64, uint64, error) {
+	value, err := readString(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var read, write uint64
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[1] {
+		case "Read":
+			read += n
+		case "Write":
+			write += n
+		}
+	}
+	return read, write, nil
+}
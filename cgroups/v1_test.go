@@ -0,0 +1,124 @@
+package cgroups
+
+import (
+	"path"
+	"testing"
+)
+
+func TestV1MemoryLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	res := NewResources()
+	res.Memory, res.Swap, res.MemoryReservation = 512, 256, 128
+	if err := c.ConfigureCGroups(testContainerID, res); err != nil {
+		t.Fatal(err)
+	}
+	memDir := path.Join(root, "memory", c.group(testContainerID))
+	assertFile(t, path.Join(memDir, "memory.limit_in_bytes"), "536870912")
+	/* memsw counts memory and swap together */
+	assertFile(t, path.Join(memDir, "memory.memsw.limit_in_bytes"), "805306368")
+	assertFile(t, path.Join(memDir, "memory.soft_limit_in_bytes"), "134217728")
+	assertNoFile(t, path.Join(memDir, "memory.swappiness"))
+	assertNoFile(t, path.Join(memDir, "memory.oom_control"))
+}
+
+func TestV1MemoryWithoutSwap(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	res := NewResources()
+	res.Memory = 64
+	if err := c.ConfigureCGroups(testContainerID, res); err != nil {
+		t.Fatal(err)
+	}
+	memDir := path.Join(root, "memory", c.group(testContainerID))
+	assertFile(t, path.Join(memDir, "memory.limit_in_bytes"), "67108864")
+	assertNoFile(t, path.Join(memDir, "memory.memsw.limit_in_bytes"))
+}
+
+func TestV1CpuLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	res := NewResources()
+	res.Cpus, res.Pids, res.CpuShares = 0.5, 100, 512
+	if err := c.ConfigureCGroups(testContainerID, res); err != nil {
+		t.Fatal(err)
+	}
+	cpuDir := path.Join(root, "cpu", c.group(testContainerID))
+	assertFile(t, path.Join(cpuDir, "cpu.cfs_period_us"), "1000000")
+	assertFile(t, path.Join(cpuDir, "cpu.cfs_quota_us"), "500000")
+	assertFile(t, path.Join(cpuDir, "cpu.shares"), "512")
+	assertFile(t, path.Join(root, "pids", c.group(testContainerID), "pids.max"), "100")
+}
+
+func TestV1CpuWeightIsConvertedToShares(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	res := NewResources()
+	res.CpuWeight, res.CpuPeriod, res.CpuQuota = 100, 100000, 25000
+	if err := c.ConfigureCGroups(testContainerID, res); err != nil {
+		t.Fatal(err)
+	}
+	cpuDir := path.Join(root, "cpu", c.group(testContainerID))
+	assertFile(t, path.Join(cpuDir, "cpu.shares"), "2597")
+	assertFile(t, path.Join(cpuDir, "cpu.cfs_period_us"), "100000")
+	assertFile(t, path.Join(cpuDir, "cpu.cfs_quota_us"), "25000")
+}
+
+func TestV1BlkioLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	blkioDir := path.Join(root, "blkio", c.group(testContainerID))
+	writeTestFile(t, path.Join(blkioDir, "blkio.weight"), "500")
+	res := NewResources()
+	res.BlkioWeight = 300
+	res.DeviceReadBps = []ThrottleDevice{{Path: "/dev/sda", Major: 8, Minor: 0, Rate: 1048576}}
+	res.DeviceWriteIops = []ThrottleDevice{{Path: "/dev/sdb", Major: 8, Minor: 16, Rate: 100}}
+	if err := c.ConfigureCGroups(testContainerID, res); err != nil {
+		t.Fatal(err)
+	}
+	assertFile(t, path.Join(blkioDir, "blkio.weight"), "300")
+	assertFile(t, path.Join(blkioDir, "blkio.throttle.read_bps_device"), "8:0 1048576")
+	assertFile(t, path.Join(blkioDir, "blkio.throttle.write_iops_device"), "8:16 100")
+}
+
+func TestV1DevicesAreDeniedFirst(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	if err := c.ConfigureCGroups(testContainerID, NewResources()); err != nil {
+		t.Fatal(err)
+	}
+	devicesDir := path.Join(root, "devices", c.group(testContainerID))
+	assertFile(t, path.Join(devicesDir, "devices.deny"), "a")
+	/* Every rule is a write of its own, the fake file keeps the last one */
+	defaults := DefaultDevices()
+	assertFile(t, path.Join(devicesDir, "devices.allow"), defaults[len(defaults)-1].rule())
+}
+
+func TestV1UpdateResetsLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 1)
+	writeTestFile(t, path.Join(root, "memory", c.Parent(), "memory.swappiness"), "60")
+	writeTestFile(t, path.Join(root, "cpuset", c.Parent(), "cpuset.cpus"), "0-3")
+	old := NewResources()
+	old.Memory, old.Swap, old.MemoryReservation, old.MemorySwappiness = 512, 256, 128, 10
+	old.OomKillDisable, old.Cpus, old.Pids, old.CpuShares, old.CpusetCpus = true, 0.5, 100, 512, "0"
+	old.DeviceReadBps = []ThrottleDevice{{Path: "/dev/sda", Major: 8, Minor: 0, Rate: 1048576}}
+	old.DeviceWriteBps = []ThrottleDevice{{Path: "/dev/sdb", Major: 8, Minor: 16, Rate: 1048576}}
+	if err := c.ConfigureCGroups(testContainerID, old); err != nil {
+		t.Fatal(err)
+	}
+
+	res := NewResources()
+	res.DeviceReadBps = old.DeviceReadBps
+	if err := c.UpdateCGroups(testContainerID, old, res); err != nil {
+		t.Fatal(err)
+	}
+	memDir := path.Join(root, "memory", c.group(testContainerID))
+	assertFile(t, path.Join(memDir, "memory.limit_in_bytes"), "-1")
+	assertFile(t, path.Join(memDir, "memory.memsw.limit_in_bytes"), "-1")
+	assertFile(t, path.Join(memDir, "memory.soft_limit_in_bytes"), "-1")
+	assertFile(t, path.Join(memDir, "memory.swappiness"), "60")
+	assertFile(t, path.Join(memDir, "memory.oom_control"), "0")
+	cpuDir := path.Join(root, "cpu", c.group(testContainerID))
+	assertFile(t, path.Join(cpuDir, "cpu.cfs_quota_us"), "-1")
+	assertFile(t, path.Join(cpuDir, "cpu.cfs_period_us"), "100000")
+	assertFile(t, path.Join(cpuDir, "cpu.shares"), "1024")
+	assertFile(t, path.Join(root, "pids", c.group(testContainerID), "pids.max"), "max")
+	assertFile(t, path.Join(root, "cpuset", c.group(testContainerID), "cpuset.cpus"), "0-3")
+	blkioDir := path.Join(root, "blkio", c.group(testContainerID))
+	assertFile(t, path.Join(blkioDir, "blkio.throttle.read_bps_device"), "8:0 1048576")
+	assertFile(t, path.Join(blkioDir, "blkio.throttle.write_bps_device"), "8:16 0")
+}
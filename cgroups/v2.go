@@ -0,0 +1,429 @@
+package cgroups
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+	v2Driver manages <cgroup-parent>/<container-id> groups in the unified
+	hierarchy, given as paths relative to its root. Controllers have to be
+	enabled in cgroup.subtree_control of every ancestor before their files
+	show up in the container group.
+*/
+type v2Driver struct {
+	root string
+}
+
+var v2Controllers = []string{"cpu", "cpuset", "hugetlb", "io", "memory", "pids"}
+
+/* The values of a new group, which ResetCGroups restores */
+const (
+	v2DefaultCpuMax    = "max 100000"
+	v2DefaultCpuWeight = 100
+	v2DefaultIOWeight  = 100
+)
+
+func (d v2Driver) Version() int {
+	return 2
+}
+
+func (d v2Driver) CheckSupport(res Resources) error {
+	if res.KernelMemory > 0 {
+		return fmt.Errorf("--kernel-memory is not supported on cgroup v2, kernel memory is part of --mem")
+	}
+	if res.MemorySwappiness >= 0 {
+		return fmt.Errorf("--memory-swappiness is not supported on cgroup v2")
+	}
+	if res.OomKillDisable {
+		return fmt.Errorf("--oom-kill-disable is not supported on cgroup v2")
+	}
+	return nil
+}
+
+func (d v2Driver) getCGroupDir(group string) string {
+	return path.Join(d.root, group)
+}
+
+func (d v2Driver) CreateCGroups(group string) error {
+	cgroupDir := d.root
+	for _, name := range strings.Split(group, "/") {
+		if err := d.enableControllers(cgroupDir); err != nil {
+			return err
+		}
+		cgroupDir = path.Join(cgroupDir, name)
+		if err := os.Mkdir(cgroupDir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v2Driver) Exists(group string) bool {
+	_, err := os.Stat(d.getCGroupDir(group))
+	return err == nil
+}
+
+func (d v2Driver) AddProcess(group string, pid int) error {
+	return writeFile(d.getCGroupDir(group)+"/cgroup.procs", strconv.Itoa(pid))
+}
+
+/*
+	memory.events is a kernfs file that raises an inotify modify event every
+	time one of its counters changes, an OOM kill shows up in oom_kill.
+*/
+func (d v2Driver) NotifyOOM(group string) (*OOMNotifier, error) {
+	eventsPath := d.getCGroupDir(group) + "/memory.events"
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	inotifyFile := os.NewFile(uintptr(fd), "oom-inotify")
+	if _, err := unix.InotifyAddWatch(fd, eventsPath, unix.IN_MODIFY); err != nil {
+		inotifyFile.Close()
+		return nil, err
+	}
+
+	events := make(chan struct{})
+	go func() {
+		defer close(events)
+		buf := make([]byte, unix.SizeofInotifyEvent+unix.NAME_MAX+1)
+		var kills int64
+		for {
+			if _, err := inotifyFile.Read(buf); err != nil {
+				return
+			}
+			values, err := readKeyedFile(eventsPath)
+			if err != nil {
+				return
+			}
+			if values["oom_kill"] > kills {
+				kills = values["oom_kill"]
+				events <- struct{}{}
+			}
+		}
+	}()
+	return &OOMNotifier{Events: events, file: inotifyFile}, nil
+}
+
+/*
+	Enables the controllers fdocker uses for the children of cgroupDir, as far
+	as they are available in cgroupDir itself.
+*/
+func (d v2Driver) enableControllers(cgroupDir string) error {
+	available, err := readString(cgroupDir + "/cgroup.controllers")
+	if err != nil {
+		return err
+	}
+	var enable []string
+	for _, controller := range v2Controllers {
+		for _, a := range strings.Fields(available) {
+			if a == controller {
+				enable = append(enable, "+"+controller)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	return writeFile(cgroupDir+"/cgroup.subtree_control", strings.Join(enable, " "))
+}
+
+func (d v2Driver) RemoveCGroups(group string) error {
+	return os.Remove(d.getCGroupDir(group))
+}
+
+func (d v2Driver) ConfigureCGroups(group string, res Resources) error {
+	cgroupDir := d.getCGroupDir(group)
+	if res.Memory > 0 {
+		if err := writeFile(cgroupDir+"/memory.max", strconv.FormatInt(mbToBytes(res.Memory), 10)); err != nil {
+			return err
+		}
+		/* Unlike memory.memsw.limit_in_bytes in v1, memory.swap.max only counts swap */
+		if res.Swap >= 0 {
+			if err := writeFile(cgroupDir+"/memory.swap.max", strconv.FormatInt(mbToBytes(res.Swap), 10)); err != nil {
+				return err
+			}
+		}
+	}
+	if res.MemoryReservation > 0 {
+		if err := writeFile(cgroupDir+"/memory.low", strconv.FormatInt(mbToBytes(res.MemoryReservation), 10)); err != nil {
+			return err
+		}
+	}
+	if res.Cpus > 0 {
+		cpuMax := strconv.FormatInt(cpuQuota(res.Cpus), 10) + " " + strconv.Itoa(cpuPeriod)
+		if err := writeFile(cgroupDir+"/cpu.max", cpuMax); err != nil {
+			return err
+		}
+	}
+	if res.Pids > 0 {
+		if err := writeFile(cgroupDir+"/pids.max", strconv.Itoa(res.Pids)); err != nil {
+			return err
+		}
+	}
+	if len(res.CpusetCpus) > 0 {
+		if err := writeFile(cgroupDir+"/cpuset.cpus", res.CpusetCpus); err != nil {
+			return err
+		}
+	}
+	if len(res.CpusetMems) > 0 {
+		if err := writeFile(cgroupDir+"/cpuset.mems", res.CpusetMems); err != nil {
+			return err
+		}
+	}
+	weight := res.CpuWeight
+	if res.CpuShares > 0 {
+		weight = sharesToWeight(res.CpuShares)
+	}
+	if weight > 0 {
+		if err := writeFile(cgroupDir+"/cpu.weight", strconv.Itoa(weight)); err != nil {
+			return err
+		}
+	}
+	/*
+		cpu.max holds "$MAX $PERIOD". Writing the quota alone keeps the
+		current period, "max" as quota keeps the group unlimited.
+	*/
+	if res.CpuQuota > 0 || res.CpuPeriod > 0 {
+		cpuMax := "max"
+		if res.CpuQuota > 0 {
+			cpuMax = strconv.Itoa(res.CpuQuota)
+		}
+		if res.CpuPeriod > 0 {
+			cpuMax += " " + strconv.Itoa(res.CpuPeriod)
+		}
+		if err := writeFile(cgroupDir+"/cpu.max", cpuMax); err != nil {
+			return err
+		}
+	}
+	for _, limit := range res.HugetlbLimits {
+		if err := writeFile(cgroupDir+"/hugetlb."+limit.PageSize+".max", strconv.FormatUint(limit.Limit, 10)); err != nil {
+			return err
+		}
+	}
+	return d.setIOLimits(group, res)
+}
+
+/*
+	Lifts the limits set in res: limits take "max", weights go back to the
+	kernel defaults and an empty cpuset takes the one of the parent.
+*/
+func (d v2Driver) ResetCGroups(group string, res Resources) error {
+	cgroupDir := d.getCGroupDir(group)
+	var files, values []string
+	reset := func(file string, value string) {
+		files = append(files, file)
+		values = append(values, value)
+	}
+	if res.Memory > 0 {
+		reset(cgroupDir+"/memory.max", "max")
+	}
+	if res.Swap >= 0 {
+		reset(cgroupDir+"/memory.swap.max", "max")
+	}
+	if res.MemoryReservation > 0 {
+		reset(cgroupDir+"/memory.low", "0")
+	}
+	if res.Cpus > 0 || res.CpuQuota > 0 || res.CpuPeriod > 0 {
+		reset(cgroupDir+"/cpu.max", v2DefaultCpuMax)
+	}
+	if res.CpuShares > 0 || res.CpuWeight > 0 {
+		reset(cgroupDir+"/cpu.weight", strconv.Itoa(v2DefaultCpuWeight))
+	}
+	if res.Pids > 0 {
+		reset(cgroupDir+"/pids.max", "max")
+	}
+	if len(res.CpusetCpus) > 0 {
+		reset(cgroupDir+"/cpuset.cpus", "")
+	}
+	if len(res.CpusetMems) > 0 {
+		reset(cgroupDir+"/cpuset.mems", "")
+	}
+	for _, limit := range res.HugetlbLimits {
+		reset(cgroupDir+"/hugetlb."+limit.PageSize+".max", "max")
+	}
+	if res.BlkioWeight > 0 {
+		weightFile := cgroupDir + "/io.weight"
+		if _, err := os.Stat(weightFile); os.IsNotExist(err) {
+			weightFile = cgroupDir + "/io.bfq.weight"
+		}
+		reset(weightFile, "default "+strconv.Itoa(v2DefaultIOWeight))
+	}
+	throttles := []struct {
+		key     string
+		devices []ThrottleDevice
+	}{
+		{"rbps", res.DeviceReadBps},
+		{"wbps", res.DeviceWriteBps},
+		{"riops", res.DeviceReadIops},
+		{"wiops", res.DeviceWriteIops},
+	}
+	for _, throttle := range throttles {
+		for _, device := range throttle.devices {
+			reset(cgroupDir+"/io.max", fmt.Sprintf("%d:%d %s=max", device.Major, device.Minor, throttle.key))
+		}
+	}
+	for n, file := range files {
+		if err := writeFile(file, values[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v2Driver) ConfigureDevices(group string, devices []Device) error {
+	return attachDeviceFilter(d.getCGroupDir(group), devices)
+}
+
+func (d v2Driver) setIOLimits(group string, res Resources) error {
+	cgroupDir := d.getCGroupDir(group)
+	if res.BlkioWeight > 0 {
+		/* io.bfq.weight of the BFQ scheduler keeps the 1..1000 scale */
+		weight := "default " + strconv.Itoa(blkioWeightToIOWeight(res.BlkioWeight))
+		weightFile := cgroupDir + "/io.weight"
+		if _, err := os.Stat(weightFile); os.IsNotExist(err) {
+			weight = "default " + strconv.Itoa(res.BlkioWeight)
+			weightFile = cgroupDir + "/io.bfq.weight"
+		}
+		if err := writeFile(weightFile, weight); err != nil {
+			return err
+		}
+	}
+
+	/* io.max takes one "MAJ:MIN rbps=.. wbps=.. riops=.. wiops=.." line per device */
+	var devices []string
+	limits := make(map[string][]string)
+	throttles := []struct {
+		key     string
+		devices []ThrottleDevice
+	}{
+		{"rbps", res.DeviceReadBps},
+		{"wbps", res.DeviceWriteBps},
+		{"riops", res.DeviceReadIops},
+		{"wiops", res.DeviceWriteIops},
+	}
+	for _, throttle := range throttles {
+		for _, device := range throttle.devices {
+			id := fmt.Sprintf("%d:%d", device.Major, device.Minor)
+			if _, ok := limits[id]; !ok {
+				devices = append(devices, id)
+			}
+			limits[id] = append(limits[id], fmt.Sprintf("%s=%d", throttle.key, device.Rate))
+		}
+	}
+	for _, id := range devices {
+		if err := writeFile(cgroupDir+"/io.max", id+" "+strings.Join(limits[id], " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d v2Driver) ListCGroups(parent string) ([]string, error) {
+	dirs, err := listDirs(d.getCGroupDir(parent))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return dirs, err
+}
+
+func (d v2Driver) GetProcs(group string) ([]int, error) {
+	return readProcs(d.getCGroupDir(group) + "/cgroup.procs")
+}
+
+func (d v2Driver) GetStats(group string) (*Stats, error) {
+	var err error
+	stats := &Stats{}
+	cgroupDir := d.getCGroupDir(group)
+	if stats.MemoryUsage, err = readInt(cgroupDir + "/memory.current"); err != nil {
+		return nil, err
+	}
+	if stats.MemoryLimit, err = readInt(cgroupDir + "/memory.max"); err != nil {
+		return nil, err
+	}
+	/* memory.peak only exists since Linux 5.19 */
+	if stats.MemoryMaxUsage, err = readInt(cgroupDir + "/memory.peak"); err != nil {
+		stats.MemoryMaxUsage = stats.MemoryUsage
+	}
+	memoryEvents, err := readKeyedFile(cgroupDir + "/memory.events")
+	if err != nil {
+		return nil, err
+	}
+	stats.OomKills = memoryEvents["oom_kill"]
+	stats.MemoryEvents = &MemoryEvents{
+		Low:     memoryEvents["low"],
+		High:    memoryEvents["high"],
+		Max:     memoryEvents["max"],
+		Oom:     memoryEvents["oom"],
+		OomKill: memoryEvents["oom_kill"],
+	}
+	if stats.CpuPressure, err = readPressure(cgroupDir + "/cpu.pressure"); err != nil {
+		return nil, err
+	}
+	if stats.MemoryPressure, err = readPressure(cgroupDir + "/memory.pressure"); err != nil {
+		return nil, err
+	}
+	if stats.IoPressure, err = readPressure(cgroupDir + "/io.pressure"); err != nil {
+		return nil, err
+	}
+	cpuStat, err := readKeyedFile(cgroupDir + "/cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	stats.CpuUsage = cpuStat["usage_usec"] * 1000
+	stats.CpuUser = cpuStat["user_usec"] * 1000
+	stats.CpuSystem = cpuStat["system_usec"] * 1000
+	if stats.Pids, err = readInt(cgroupDir + "/pids.current"); err != nil {
+		return nil, err
+	}
+	/* pids.peak only exists since Linux 6.1 */
+	if peak, err := readInt(cgroupDir + "/pids.peak"); err == nil {
+		stats.PidsPeak = peak
+	}
+	if stats.PidsLimit, err = readInt(cgroupDir + "/pids.max"); err != nil {
+		return nil, err
+	}
+	if err := readIOStat(cgroupDir+"/io.stat", stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+/*
+	io.stat has one "MAJ:MIN rbytes=.. wbytes=.. rios=.. wios=.." line per
+	device, the counters are summed up over all devices.
+*/
+func readIOStat(filePath string, stats *Stats) error {
+	value, err := readString(filePath)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(value, "\n") {
+		for _, field := range strings.Fields(line) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			n, err := strconv.ParseUint(kv[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "rbytes":
+				stats.IoReadBytes += n
+			case "wbytes":
+				stats.IoWriteBytes += n
+			case "rios":
+				stats.IoReadOps += n
+			case "wios":
+				stats.IoWriteOps += n
+			}
+		}
+	}
+	return nil
+}
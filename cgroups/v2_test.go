@@ -0,0 +1,121 @@
+package cgroups
+
+import (
+	"path"
+	"testing"
+)
+
+/*
+	ConfigureCGroups attaches an eBPF device filter on cgroup v2, which a
+	fake cgroupfs can not take, so the v2 limits are applied as an update.
+*/
+func configureV2(t *testing.T, c Accessor, res Resources) {
+	t.Helper()
+	if err := c.UpdateCGroups(testContainerID, NewResources(), res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestV2MemoryLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 2)
+	res := NewResources()
+	res.Memory, res.Swap, res.MemoryReservation = 512, 256, 128
+	configureV2(t, c, res)
+	cgroupDir := path.Join(root, c.group(testContainerID))
+	assertFile(t, path.Join(cgroupDir, "memory.max"), "536870912")
+	/* memory.swap.max only counts swap */
+	assertFile(t, path.Join(cgroupDir, "memory.swap.max"), "268435456")
+	assertFile(t, path.Join(cgroupDir, "memory.low"), "134217728")
+}
+
+func TestV2CpuLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 2)
+	res := NewResources()
+	res.Cpus, res.Pids, res.CpuShares = 0.5, 100, 1024
+	configureV2(t, c, res)
+	cgroupDir := path.Join(root, c.group(testContainerID))
+	assertFile(t, path.Join(cgroupDir, "cpu.max"), "500000 1000000")
+	assertFile(t, path.Join(cgroupDir, "cpu.weight"), "39")
+	assertFile(t, path.Join(cgroupDir, "pids.max"), "100")
+}
+
+func TestV2CpuQuotaKeepsPeriod(t *testing.T) {
+	c, root := newTestAccessor(t, 2)
+	res := NewResources()
+	res.CpuQuota = 50000
+	configureV2(t, c, res)
+	assertFile(t, path.Join(root, c.group(testContainerID), "cpu.max"), "50000")
+
+	res.CpuQuota, res.CpuPeriod = 0, 200000
+	configureV2(t, c, res)
+	assertFile(t, path.Join(root, c.group(testContainerID), "cpu.max"), "max 200000")
+}
+
+func TestV2IOLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 2)
+	cgroupDir := path.Join(root, c.group(testContainerID))
+	writeTestFile(t, path.Join(cgroupDir, "io.weight"), "default 100")
+	res := NewResources()
+	res.BlkioWeight = 1000
+	res.DeviceReadBps = []ThrottleDevice{{Path: "/dev/sda", Major: 8, Minor: 0, Rate: 1048576}}
+	res.DeviceWriteIops = []ThrottleDevice{{Path: "/dev/sda", Major: 8, Minor: 0, Rate: 100}}
+	configureV2(t, c, res)
+	assertFile(t, path.Join(cgroupDir, "io.weight"), "default 10000")
+	/* All limits of a device go on one line */
+	assertFile(t, path.Join(cgroupDir, "io.max"), "8:0 rbps=1048576 wiops=100")
+}
+
+func TestV2RejectsV1OnlyLimits(t *testing.T) {
+	c, _ := newTestAccessor(t, 2)
+	for _, modify := range []func(res *Resources){
+		func(res *Resources) { res.KernelMemory = 64 },
+		func(res *Resources) { res.MemorySwappiness = 10 },
+		func(res *Resources) { res.OomKillDisable = true },
+	} {
+		res := NewResources()
+		modify(&res)
+		if err := c.ValidateResources(res); err == nil {
+			t.Errorf("expected %+v to be rejected on cgroup v2", res)
+		}
+	}
+}
+
+func TestV2UpdateResetsLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 2)
+	old := NewResources()
+	old.Memory, old.Swap, old.MemoryReservation = 512, 256, 128
+	old.Cpus, old.Pids, old.CpuWeight, old.CpusetCpus = 0.5, 100, 200, "0"
+	old.DeviceReadBps = []ThrottleDevice{{Path: "/dev/sda", Major: 8, Minor: 0, Rate: 1048576}}
+	configureV2(t, c, old)
+
+	res := NewResources()
+	if err := c.UpdateCGroups(testContainerID, old, res); err != nil {
+		t.Fatal(err)
+	}
+	cgroupDir := path.Join(root, c.group(testContainerID))
+	assertFile(t, path.Join(cgroupDir, "memory.max"), "max")
+	assertFile(t, path.Join(cgroupDir, "memory.swap.max"), "max")
+	assertFile(t, path.Join(cgroupDir, "memory.low"), "0")
+	assertFile(t, path.Join(cgroupDir, "cpu.max"), "max 100000")
+	assertFile(t, path.Join(cgroupDir, "cpu.weight"), "100")
+	assertFile(t, path.Join(cgroupDir, "pids.max"), "max")
+	assertFile(t, path.Join(cgroupDir, "cpuset.cpus"), "")
+	assertFile(t, path.Join(cgroupDir, "io.max"), "8:0 rbps=max")
+}
+
+func TestV2UpdateKeepsUnchangedLimits(t *testing.T) {
+	c, root := newTestAccessor(t, 2)
+	old := NewResources()
+	old.Memory, old.Pids = 512, 100
+	configureV2(t, c, old)
+
+	res := old
+	res.Memory = 1024
+	if err := c.UpdateCGroups(testContainerID, old, res); err != nil {
+		t.Fatal(err)
+	}
+	cgroupDir := path.Join(root, c.group(testContainerID))
+	assertFile(t, path.Join(cgroupDir, "memory.max"), "1073741824")
+	assertFile(t, path.Join(cgroupDir, "pids.max"), "100")
+	assertNoFile(t, path.Join(cgroupDir, "memory.swap.max"))
+}
@@ -2,12 +2,25 @@ package cmds
 
 import (
 	"fdocker/cmds/impls/childmode"
+	"fdocker/cmds/impls/cp"
+	"fdocker/cmds/impls/diff"
+	"fdocker/cmds/impls/events"
+	"fdocker/cmds/impls/imagecmd"
 	"fdocker/cmds/impls/images"
+	"fdocker/cmds/impls/inspect"
+	"fdocker/cmds/impls/load"
 	"fdocker/cmds/impls/ps"
+	"fdocker/cmds/impls/pull"
+	"fdocker/cmds/impls/push"
+	"fdocker/cmds/impls/registrycmd"
+	"fdocker/cmds/impls/rm"
 	"fdocker/cmds/impls/rmi"
 	"fdocker/cmds/impls/run"
+	"fdocker/cmds/impls/save"
 	"fdocker/cmds/impls/setupnetns"
 	"fdocker/cmds/impls/setupveth"
+	"fdocker/cmds/impls/stats"
+	"fdocker/cmds/impls/update"
 	cmdsinterface "fdocker/cmds/interface"
 	"sort"
 )
@@ -24,12 +37,25 @@ func GetCmdExecutors() map[string]cmdsinterface.CmdExecutor {
 func getCmdExecutorList() []cmdsinterface.CmdExecutor {
 	executors := []cmdsinterface.CmdExecutor{
 		childmode.New(),
+		cp.New(),
+		diff.New(),
+		events.New(),
+		imagecmd.New(),
 		images.New(),
+		inspect.New(),
+		load.New(),
 		ps.New(),
+		pull.New(),
+		push.New(),
+		registrycmd.New(),
+		rm.New(),
 		rmi.New(),
 		run.New(),
+		save.New(),
 		setupnetns.New(),
 		setupveth.New(),
+		stats.New(),
+		update.New(),
 	}
 	sort.Slice(executors, func(i, j int) bool {
 		return executors[i].CmdName() < executors[i].CmdName()
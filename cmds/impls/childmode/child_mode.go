@@ -2,7 +2,7 @@ package childmode
 
 import (
 	"fdocker/cgroups"
-	"fdocker/image"
+	"fdocker/container"
 	"fdocker/network"
 	"fdocker/utils"
 	"fdocker/workdirs"
@@ -12,6 +12,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"syscall"
 )
 
 type Executor struct {
@@ -37,59 +38,87 @@ func (e Executor) Exec() {
 	fs := flag.FlagSet{}
 	fs.ParseErrorsWhitelist.UnknownFlags = true
 
-	mem := fs.Int("mem", -1, "Max RAM to allow in  MB")
-	swap := fs.Int("swap", -1, "Max swap to allow in  MB")
-	pids := fs.Int("pids", -1, "Number of max processes to allow")
-	cpus := fs.Float64("cpus", -1, "Number of CPU cores to restrict to")
-	image := fs.String("img", "", "Container image")
 	if err := fs.Parse(os.Args[2:]); err != nil {
 		fmt.Println("Error parsing: ", err)
 	}
-	if len(fs.Args()) < 2 {
-		log.Fatalf("Please pass image name and command to run")
+	if len(fs.Args()) < 1 {
+		log.Fatalf("Please pass the container ID")
 	}
-	execContainerCommand(*mem, *swap, *pids, *cpus, fs.Args()[0], *image, fs.Args()[1:])
+	os.Exit(execContainerCommand(fs.Args()[0]))
 }
 
 /*
-	Called if this program is executed with "child-mode" as the first argument
+	Called if this program is executed with "child-mode" as the first argument.
+	The cgroups are created and configured by run, child-mode only joins them
+	so the command is accounted to the container. The command, its
+	environment, working directory and user are the ones run saved in the
+	state of the container. Returns the exit code of the command.
 */
-func execContainerCommand(mem int, swap int, pids int, cpus float64,
-	containerID string, imageShaHex string, args []string) {
+func execContainerCommand(containerID string) int {
 	mntPath := workdirs.GetContainerFSHome(containerID) + "/mnt"
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	state, err := container.GetAccessor().LoadState(containerID)
+	utils.MustWithMsg(err, "Unable to load container state")
+	/* The executable is looked up after the chroot, in the PATH of the container */
+	cmd := &exec.Cmd{
+		Args:   state.Command,
+		Env:    state.Env,
+		Dir:    "/",
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
 
-	imgAccessor := image.GetAccessor()
 	netAccessor := network.GetAccessor()
-	cGroupsAccessor := cgroups.GetAccessor()
-	imgConfig := imgAccessor.ParseContainerConfig(imageShaHex)
 	utils.MustWithMsg(unix.Sethostname([]byte(containerID)), "Unable to set hostname")
 	//utils.MustWithMsg(netAccessor.JoinContainerNetworkNamespace(containerID), "Unable to join container network namespace")
-	cGroupsAccessor.CreateCGroups(containerID, true)
-	cGroupsAccessor.ConfigureCGroups(containerID, mem, swap, pids, cpus)
+	utils.MustWithMsg(state.CGroups().AddProcess(containerID, os.Getpid()), "Unable to join cgroups")
 	utils.MustWithMsg(copyNameserverConfig(containerID), "Unable to copy resolve.conf")
+	utils.Must(utils.EnsureDirs([]string{mntPath + "/dev"}))
+	utils.MustWithMsg(unix.Mount("tmpfs", mntPath+"/dev", "tmpfs", 0, "mode=755"), "Unable to mount tmpfs on /dev")
+	devices, err := setupDevices(mntPath, append(cgroups.DefaultDevices(), state.Resources.Devices...))
+	utils.MustWithMsg(err, "Unable to set up devices")
 	utils.MustWithMsg(unix.Chroot(mntPath), "Unable to chroot")
 	utils.MustWithMsg(os.Chdir("/"), "Unable to change directory")
 	utils.Must(utils.EnsureDirs([]string{"/proc", "/sys"}))
 	utils.MustWithMsg(unix.Mount("proc", "/proc", "proc", 0, ""), "Unable to mount proc")
 	utils.MustWithMsg(unix.Mount("tmpfs", "/tmp", "tmpfs", 0, ""), "Unable to mount tmpfs")
-	utils.MustWithMsg(unix.Mount("tmpfs", "/dev", "tmpfs", 0, ""), "Unable to mount tmpfs on /dev")
-	utils.Must(utils.EnsureDirs([]string{"/dev/pts"}))
-	utils.MustWithMsg(unix.Mount("devpts", "/dev/pts", "devpts", 0, ""), "Unable to mount devpts")
+	utils.MustWithMsg(unix.Mount("devpts", "/dev/pts", "devpts", 0, "newinstance,ptmxmode=0666,mode=0620"),
+		"Unable to mount devpts")
 	//utils.MustWithMsg(unix.Mount("sysfs", "/sys", "sysfs", 0, ""), "Unable to mount sysfs")
 	netAccessor.SetupLocalInterface()
-	cmd.Env = imgConfig.Config.Env
-	if err := cmd.Run(); err != nil {
+	if len(state.WorkingDir) > 0 {
+		utils.MustWithMsg(os.MkdirAll(state.WorkingDir, 0755), "Unable to create working directory")
+		cmd.Dir = state.WorkingDir
+	}
+	if len(state.User) > 0 {
+		user, err := lookupUser(state.User)
+		utils.MustWithMsg(err, "Unable to switch to user "+state.User)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: user.uid, Gid: user.gid, Groups: user.groups},
+		}
+		if _, ok := container.LookupEnv(cmd.Env, "HOME"); !ok {
+			cmd.Env = append(cmd.Env, "HOME="+user.home)
+		}
+	}
+	for _, ulimit := range state.Ulimits {
+		utils.MustWithMsg(ulimit.Apply(), "Unable to set ulimit "+ulimit.Name)
+	}
+	exitCode := 0
+	pathEnv, _ := container.LookupEnv(cmd.Env, "PATH")
+	if cmd.Path, err = lookPath(state.Command[0], cmd.Dir, pathEnv); err == nil {
+		exitCode, err = utils.ExitCode(cmd.Run())
+	}
+	if err != nil {
 		log.Printf("container run failed, err = [%v]", err)
+		exitCode = execFailureExitCode(err)
 	}
 	utils.Must(unix.Unmount("/dev/pts", 0))
+	unmountDevices(devices)
 	utils.Must(unix.Unmount("/dev", 0))
 	//utils.Must(unix.Unmount("/sys", 0))
 	utils.Must(unix.Unmount("/proc", 0))
 	utils.Must(unix.Unmount("/tmp", 0))
+	return exitCode
 }
 
 func copyNameserverConfig(containerID string) error {
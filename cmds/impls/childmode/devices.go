@@ -0,0 +1,70 @@
+package childmode
+
+import (
+	"fdocker/cgroups"
+	"fdocker/utils"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+/*
+	Populates the tmpfs mounted on <mntPath>/dev before the chroot. Device
+	nodes can not be created with mknod inside a user namespace, so the host
+	nodes are bind mounted onto empty files instead, the device cgroup
+	decides what can actually be done with them. Returns the container paths
+	of the bind mounts so they can be unmounted when the command is done.
+*/
+func setupDevices(mntPath string, devices []cgroups.Device) ([]string, error) {
+	var mounted []string
+	for _, device := range devices {
+		if len(device.PathOnHost) == 0 {
+			continue
+		}
+		if _, err := os.Stat(device.PathOnHost); os.IsNotExist(err) {
+			log.Printf("Warning: device %s does not exist on the host\n", device.PathOnHost)
+			continue
+		}
+		target, err := utils.ResolvePathInRoot(mntPath, device.PathInContainer)
+		if err != nil {
+			return mounted, err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return mounted, err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return mounted, err
+		}
+		f.Close()
+		if err := unix.Mount(device.PathOnHost, target, "", unix.MS_BIND, ""); err != nil {
+			return mounted, err
+		}
+		containerPath, _ := filepath.Rel(mntPath, target)
+		mounted = append(mounted, "/"+containerPath)
+	}
+	devPath := filepath.Join(mntPath, "dev")
+	if err := utils.EnsureDirs([]string{filepath.Join(devPath, "pts")}); err != nil {
+		return mounted, err
+	}
+	links := map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(devPath, name)); err != nil {
+			return mounted, err
+		}
+	}
+	return mounted, nil
+}
+
+func unmountDevices(mounted []string) {
+	for i := len(mounted) - 1; i >= 0; i-- {
+		utils.Must(unix.Unmount(mounted[i], 0))
+	}
+}
@@ -0,0 +1,80 @@
+package childmode
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/* Exit codes of shells and docker when the command can not be run */
+const (
+	exitCodeNotExecutable = 126
+	exitCodeNotFound      = 127
+)
+
+/*
+	Finds the executable of a command inside the container, so it must be
+	called after the chroot. Names without a slash are searched in the
+	directories of pathEnv, others are taken relative to dir, the working
+	directory of the command. A file that is found but can not be executed
+	is only reported if no later directory has an executable one.
+*/
+func lookPath(file string, dir string, pathEnv string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, checkExecutable(inDir(dir, file))
+	}
+	var denied error
+	for _, pathDir := range filepath.SplitList(pathEnv) {
+		if len(pathDir) == 0 {
+			pathDir = "."
+		}
+		candidate := filepath.Join(pathDir, file)
+		/* Join drops the ./ of "." entries, without a slash the name would be searched again */
+		if !filepath.IsAbs(candidate) {
+			candidate = "./" + candidate
+		}
+		err := checkExecutable(inDir(dir, candidate))
+		if err == nil {
+			return candidate, nil
+		}
+		if errors.Is(err, os.ErrPermission) && denied == nil {
+			denied = err
+		}
+	}
+	if denied != nil {
+		return "", denied
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func inDir(dir string, file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+func checkExecutable(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return &os.PathError{Op: "exec", Path: file, Err: syscall.EACCES}
+	}
+	return nil
+}
+
+/*
+	Maps the error of a command that could not be started to an exit code,
+	exec also fails with ENOENT if the interpreter of a script is missing.
+*/
+func execFailureExitCode(err error) int {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return exitCodeNotFound
+	}
+	return exitCodeNotExecutable
+}
@@ -0,0 +1,118 @@
+package childmode
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* The user the command of a container runs as */
+type execUser struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	home   string
+}
+
+/*
+	Resolves the user of an image, a name or uid optionally followed by
+	:group or :gid, against /etc/passwd and /etc/group of the container the
+	way docker does. Numeric IDs do not need entries, a user without one
+	gets gid 0. Must be called after the chroot.
+*/
+func lookupUser(spec string) (*execUser, error) {
+	userSpec, groupSpec := spec, ""
+	if n := strings.Index(spec, ":"); n >= 0 {
+		userSpec, groupSpec = spec[:n], spec[n+1:]
+	}
+	if len(userSpec) == 0 {
+		userSpec = "0"
+	}
+	passwd, err := readEntries("/etc/passwd")
+	if err != nil {
+		return nil, err
+	}
+	user := &execUser{home: "/"}
+	name := ""
+	if entry := findEntry(passwd, userSpec, 2); entry != nil && len(entry) >= 6 {
+		uid, uidErr := parseID(entry[2])
+		gid, gidErr := parseID(entry[3])
+		if uidErr != nil || gidErr != nil {
+			return nil, fmt.Errorf("invalid passwd entry for user %s", userSpec)
+		}
+		name, user.uid, user.gid, user.home = entry[0], uid, gid, entry[5]
+	} else if user.uid, err = parseID(userSpec); err != nil {
+		return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userSpec)
+	}
+
+	groups, err := readEntries("/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	if len(groupSpec) > 0 {
+		if entry := findEntry(groups, groupSpec, 2); entry != nil {
+			if user.gid, err = parseID(entry[2]); err != nil {
+				return nil, fmt.Errorf("invalid group entry for group %s", groupSpec)
+			}
+		} else if user.gid, err = parseID(groupSpec); err != nil {
+			return nil, fmt.Errorf("unable to find group %s: no matching entries in group file", groupSpec)
+		}
+	}
+	/* Supplementary groups list their members by name */
+	for _, entry := range groups {
+		if len(name) == 0 || len(entry) < 4 || !containsMember(entry[3], name) {
+			continue
+		}
+		if gid, err := parseID(entry[2]); err == nil && gid != user.gid {
+			user.groups = append(user.groups, gid)
+		}
+	}
+	return user, nil
+}
+
+/* Reads the colon separated entries of passwd or group, a missing file has none */
+func readEntries(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
+
+/* Finds the entry whose name, or ID in field idField, is spec */
+func findEntry(entries [][]string, spec string, idField int) []string {
+	for _, entry := range entries {
+		if len(entry) > idField && (entry[0] == spec || entry[idField] == spec) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func containsMember(members string, name string) bool {
+	for _, member := range strings.Split(members, ",") {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
@@ -0,0 +1,178 @@
+package cp
+
+import (
+	"fdocker/container"
+	"fdocker/utils"
+	"fdocker/workdirs"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "cp"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker cp <container-id>:<path> <host-path|-> | <host-path|-> <container-id>:<path>"
+}
+
+func (e Executor) Exec() {
+	args := utils.ParseArgs("Please pass source and destination to copy")
+	if len(args) < 2 {
+		log.Fatalf("Please pass source and destination to copy")
+	}
+	srcID, srcPath, srcInContainer := splitContainerPath(args[0])
+	dstID, dstPath, dstInContainer := splitContainerPath(args[1])
+
+	var err error
+	switch {
+	case srcInContainer && dstInContainer:
+		log.Fatalf("Copying between containers is not supported")
+	case srcInContainer:
+		err = copyFromContainer(srcID, srcPath, args[1])
+	case dstInContainer:
+		err = copyToContainer(args[0], dstID, dstPath)
+	default:
+		log.Fatalf("Either source or destination must be a container path")
+	}
+	if err != nil {
+		log.Fatalf("Copy failed: %v\n", err)
+	}
+}
+
+/*
+	Host paths are told apart from <container-id>:<path> the same way docker
+	does: anything starting with "/" or "." (or "-" for a tar stream) stays on
+	the host even if it contains a colon.
+*/
+func splitContainerPath(arg string) (string, string, bool) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") || arg == "-" {
+		return "", arg, false
+	}
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) < 2 || len(parts[0]) == 0 {
+		return "", arg, false
+	}
+	return parts[0], parts[1], true
+}
+
+/*
+	Running containers are accessed through their live overlay mount. For a
+	stopped container the overlay is mounted again on a temporary directory
+	for the duration of the copy.
+*/
+func withContainerRoot(containerID string, fn func(root string) error) error {
+	accessor := container.GetAccessor()
+	state, err := accessor.LoadState(containerID)
+	if err != nil {
+		return fmt.Errorf("no such container: %s", containerID)
+	}
+	if state.IsRunning() {
+		return fn(workdirs.GetContainerMntPath(containerID))
+	}
+	mntPath, err := ioutil.TempDir(workdirs.TempPath(), "cp-"+containerID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mntPath)
+	if err := accessor.MountOverlay(containerID, state.Image, mntPath); err != nil {
+		return fmt.Errorf("unable to mount container file system: %v", err)
+	}
+	defer unix.Unmount(mntPath, 0)
+	return fn(mntPath)
+}
+
+func inDir(dir string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		return filepath.Join(dir, name), nil
+	}
+}
+
+func inRoot(root string, dir string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		p := filepath.Join(dir, name)
+		parent, err := utils.ResolvePathInRoot(root, filepath.Dir(p))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(parent, filepath.Base(p)), nil
+	}
+}
+
+func copyTree(srcPath string, name string, resolve func(string) (string, error)) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(utils.WriteTar(writer, srcPath, name))
+	}()
+	err := utils.ExtractTar(reader, resolve)
+	reader.CloseWithError(err)
+	return err
+}
+
+func copyFromContainer(containerID string, containerPath string, hostPath string) error {
+	return withContainerRoot(containerID, func(root string) error {
+		name := filepath.Base(filepath.Clean("/" + containerPath))
+		if name == "/" {
+			return fmt.Errorf("copying the whole container root is not supported")
+		}
+		/* The last path element is copied as is, even if it is a symlink */
+		srcDir, err := utils.ResolvePathInRoot(root, filepath.Dir(filepath.Clean("/"+containerPath)))
+		if err != nil {
+			return err
+		}
+		srcPath := filepath.Join(srcDir, name)
+		if _, err := os.Lstat(srcPath); err != nil {
+			return fmt.Errorf("no such file or directory in container: %s", containerPath)
+		}
+		if hostPath == "-" {
+			return utils.WriteTar(os.Stdout, srcPath, name)
+		}
+		destDir, destName := hostPath, name
+		if info, err := os.Stat(hostPath); err != nil || !info.IsDir() {
+			destDir, destName = filepath.Dir(hostPath), filepath.Base(hostPath)
+		}
+		return copyTree(srcPath, destName, inDir(destDir))
+	})
+}
+
+func copyToContainer(hostPath string, containerID string, containerPath string) error {
+	return withContainerRoot(containerID, func(root string) error {
+		destPath, err := utils.ResolvePathInRoot(root, containerPath)
+		if err != nil {
+			return err
+		}
+		destInfo, destErr := os.Stat(destPath)
+		destIsDir := destErr == nil && destInfo.IsDir()
+		if hostPath == "-" {
+			if !destIsDir {
+				return fmt.Errorf("destination %s must be an existing directory when reading a tar stream", containerPath)
+			}
+			return utils.ExtractTar(os.Stdin, inRoot(root, containerPath))
+		}
+		if _, err := os.Lstat(hostPath); err != nil {
+			return err
+		}
+		destDir, destName := containerPath, filepath.Base(hostPath)
+		if !destIsDir {
+			destDir, destName = filepath.Dir(containerPath), filepath.Base(containerPath)
+		}
+		return copyTree(hostPath, destName, inRoot(root, destDir))
+	})
+}
@@ -0,0 +1,197 @@
+package diff
+
+import (
+	"fdocker/container"
+	"fdocker/image"
+	"fdocker/utils"
+	"fdocker/workdirs"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	ChangeAdded    = "A"
+	ChangeModified = "C"
+	ChangeDeleted  = "D"
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+	opaqueXattr       = "trusted.overlay.opaque"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "diff"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker diff <container-id>"
+}
+
+func (e Executor) Exec() {
+	containerID := utils.ParseSingleArg("Please pass container ID to diff")
+	changes, err := GetChanges(containerID)
+	if err != nil {
+		log.Fatalf("Unable to get changes of container %s: %v\n", containerID, err)
+	}
+	for _, change := range changes {
+		fmt.Printf("%s %s\n", change.Kind, change.Path)
+	}
+}
+
+type Change struct {
+	Kind string
+	Path string
+}
+
+/*
+	Walks the upperdir of the container and compares every entry against the
+	image layers the container was created from:
+	- a 0/0 character device is an overlayfs whiteout, i.e. a deleted path.
+	- an entry that is not visible in the lower layers was added.
+	- anything else shadows a lower entry and was changed. If it is an opaque
+	  directory, the lower entries it hides were deleted as well.
+*/
+func GetChanges(containerID string) ([]Change, error) {
+	state, err := container.GetAccessor().LoadState(containerID)
+	if err != nil {
+		return nil, err
+	}
+	layers := image.GetAccessor().GetLayerPathsForImage(state.Image)
+	upperDir := workdirs.GetContainerUpperDirPath(containerID)
+
+	var changes []Change
+	err = filepath.Walk(upperDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == upperDir {
+			return nil
+		}
+		rel := "/" + strings.TrimPrefix(p, upperDir+"/")
+		if isWhiteout(info) {
+			changes = append(changes, Change{Kind: ChangeDeleted, Path: rel})
+			return nil
+		}
+		if !existsInLowerLayers(layers, rel) {
+			changes = append(changes, Change{Kind: ChangeAdded, Path: rel})
+			return nil
+		}
+		changes = append(changes, Change{Kind: ChangeModified, Path: rel})
+		if info.IsDir() && isOpaque(p) {
+			changes = append(changes, hiddenLowerChildren(layers, upperDir, rel)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, opaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+/*
+	Image layers are extracted from their tarballs as plain files, so a layer
+	may express deletions either with overlayfs whiteouts or with the
+	.wh.<name> and .wh..wh..opq marker files of the image format.
+*/
+func existsInLowerLayers(layers []string, rel string) bool {
+	for _, layer := range layers {
+		if isWhitedOutInLayer(layer, rel) {
+			return false
+		}
+		if _, err := os.Lstat(filepath.Join(layer, rel)); err == nil {
+			return true
+		}
+		if isHiddenByLayer(layer, rel) {
+			return false
+		}
+	}
+	return false
+}
+
+func isWhitedOutInLayer(layer string, rel string) bool {
+	for p := rel; p != "/"; p = filepath.Dir(p) {
+		marker := filepath.Join(layer, filepath.Dir(p), whiteoutPrefix+filepath.Base(p))
+		if _, err := os.Lstat(marker); err == nil {
+			return true
+		}
+		if info, err := os.Lstat(filepath.Join(layer, p)); err == nil && isWhiteout(info) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHiddenByLayer(layer string, rel string) bool {
+	for p := filepath.Dir(rel); ; p = filepath.Dir(p) {
+		dir := filepath.Join(layer, p)
+		if _, err := os.Lstat(filepath.Join(dir, whiteoutOpaqueDir)); err == nil || isOpaque(dir) {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+func hiddenLowerChildren(layers []string, upperDir string, rel string) []Change {
+	var changes []Change
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		entries, err := ioutil.ReadDir(filepath.Join(layer, rel))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, whiteoutPrefix) || seen[name] {
+				continue
+			}
+			seen[name] = true
+			child := filepath.Join(rel, name)
+			if _, err := os.Lstat(filepath.Join(upperDir, child)); err == nil {
+				continue
+			}
+			if existsInLowerLayers(layers, child) {
+				changes = append(changes, Change{Kind: ChangeDeleted, Path: child})
+			}
+		}
+	}
+	return changes
+}
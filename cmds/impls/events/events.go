@@ -0,0 +1,69 @@
+package events
+
+import (
+	"fdocker/events"
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "events"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker events [--type] [container-id...]"
+}
+
+func (e Executor) Exec() {
+	fs := flag.FlagSet{}
+	eventType := fs.String("type", "", "Only show events of this type (start, die, oom, destroy)")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	allEvents, err := events.GetAccessor().ListEvents()
+	if err != nil {
+		log.Fatalf("Unable to read events: %v\n", err)
+	}
+	containerIDs := make(map[string]bool)
+	for _, containerID := range fs.Args() {
+		containerIDs[containerID] = true
+	}
+	for _, event := range allEvents {
+		if len(*eventType) > 0 && event.Type != *eventType {
+			continue
+		}
+		if len(containerIDs) > 0 && !containerIDs[event.ContainerID] {
+			continue
+		}
+		fmt.Println(formatEvent(event))
+	}
+}
+
+func formatEvent(event events.Event) string {
+	line := fmt.Sprintf("%s container %s %s", event.Time.Format(time.RFC3339), event.Type, event.ContainerID)
+	if len(event.Attributes) == 0 {
+		return line
+	}
+	var attributes []string
+	for key, value := range event.Attributes {
+		attributes = append(attributes, key+"="+value)
+	}
+	sort.Strings(attributes)
+	return line + " (" + strings.Join(attributes, ", ") + ")"
+}
@@ -0,0 +1,51 @@
+package imagecmd
+
+import (
+	"fdocker/image"
+	"fmt"
+	"log"
+	"os"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "image"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker image verify <image>"
+}
+
+func (e Executor) Exec() {
+	if len(os.Args) != 4 || os.Args[2] != "verify" {
+		log.Fatalf("Usage: %s", e.Usage())
+	}
+	verifyImage(os.Args[3])
+}
+
+/* Exits with 1 if any layer of the image differs from what was installed */
+func verifyImage(src string) {
+	accessor := image.GetAccessor()
+	imageShaHex, ok := accessor.FindImage(src)
+	if !ok {
+		log.Fatalf("No such image: %s", src)
+	}
+	problems := accessor.VerifyImage(imageShaHex)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: all %d layers verified\n", src, len(accessor.GetLayerChainIDsForImage(imageShaHex)))
+}
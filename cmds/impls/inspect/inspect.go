@@ -0,0 +1,67 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fdocker/cgroups"
+	"fdocker/container"
+	"fdocker/utils"
+	"fmt"
+	"log"
+	"os"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "inspect"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker inspect <container-id...>"
+}
+
+/*
+	inspection is the state of a container as saved in state.json. While the
+	container runs, the current cgroup stats, including pressure stall
+	information and memory events, are added.
+*/
+type inspection struct {
+	*container.State
+	Stats *cgroups.Stats `json:"stats,omitempty"`
+}
+
+func (e Executor) Exec() {
+	containerIDs := utils.ParseArgs("Please pass container ID to inspect")
+	inspections := make([]inspection, 0, len(containerIDs))
+	failed := false
+	for _, containerID := range containerIDs {
+		state, err := container.GetAccessor().LoadState(containerID)
+		if err != nil {
+			log.Printf("No such container: %s\n", containerID)
+			failed = true
+			continue
+		}
+		result := inspection{State: state}
+		if state.IsRunning() {
+			if result.Stats, err = state.CGroups().GetStats(containerID); err != nil {
+				log.Printf("Unable to read stats of container %s: %v\n", containerID, err)
+			}
+		}
+		inspections = append(inspections, result)
+	}
+	data, err := json.MarshalIndent(inspections, "", "  ")
+	utils.MustWithMsg(err, "Unable to format containers")
+	fmt.Println(string(data))
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,69 @@
+package load
+
+import (
+	"fdocker/image"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "load"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker load [-i <file>] | load --oci [--platform <os/arch[/variant]>] <dir|tar>"
+}
+
+func (e Executor) Exec() {
+	fs := flag.FlagSet{}
+	input := fs.StringP("input", "i", "", "Read from a file instead of stdin")
+	oci := fs.Bool("oci", false, "Load an OCI image layout")
+	platform := fs.String("platform", "", "Platform to select from image indexes")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	accessor := image.GetAccessor()
+	if *oci {
+		src := *input
+		if fs.NArg() > 0 {
+			src = fs.Arg(0)
+		}
+		if len(src) == 0 {
+			log.Fatalf("Please pass the OCI layout directory or archive to load")
+		}
+		selected := image.DefaultPlatform()
+		if len(*platform) > 0 {
+			var err error
+			if selected, err = image.ParsePlatform(*platform); err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}
+		accessor.LoadOCILayout(src, selected)
+		return
+	}
+	if len(*platform) > 0 {
+		log.Fatalf("--platform can only be used with --oci")
+	}
+	in := os.Stdin
+	if len(*input) > 0 {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("Unable to open %s: %v\n", *input, err)
+		}
+		defer f.Close()
+		in = f
+	}
+	accessor.LoadImages(in)
+}
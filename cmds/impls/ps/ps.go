@@ -1,11 +1,11 @@
 package ps
 
 import (
-	"bufio"
+	"fdocker/cgroups"
+	"fdocker/container"
 	"fdocker/image"
 	"fdocker/workdirs"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -36,108 +36,53 @@ func New() Executor {
 
 type RunningContainerInfo struct {
 	ContainerId string
+	ImageID     string
 	Image       string
 	Command     string
 	PID         int
 }
 
-func GetRunningContainers() ([]RunningContainerInfo, error) {
-	var containers []RunningContainerInfo
-	basePath := "/sys/fs/cgroup/cpu/fdocker"
-
-	entries, err := ioutil.ReadDir(basePath)
-	if os.IsNotExist(err) {
-		return containers, nil
-	} else {
-		if err != nil {
-			return nil, err
-		} else {
-			for _, entry := range entries {
-				if entry.IsDir() {
-					container, _ := getRunningContainerInfoForId(entry.Name())
-					if container.PID > 0 {
-						containers = append(containers, container)
-					}
-				}
-			}
-			return containers, nil
-		}
-	}
-}
-
 /*
-	This isn't a great implementation and can possibly be simplified
-	using regex. But for now, here we are. This function gets the
-	current mount points, figures out which Image is mounted for a
-	given container ID, looks it up in our images database which we
-	maintain and returns the Image and tag information.
+	Get the list of running container IDs.
+
+	Implementation logic:
+	- Every container has a state.json in its directory below the containers
+	  path, container.ListStates() loads all of them
+	- Containers that are not running are skipped, stopped ones keep their state
+	- Each state knows the cgroup parent of its container, state.CGroups()
+	  returns an accessor for it, as containers can live in different parents
+	- getRunningContainerInfoForId() reads the PIDs of the container from its
+	  cgroup. From the PID, we get the path of the command, which is relative
+	  to the overlay mount of the container. The image comes from the state.
 */
-
-func getDistribution(containerID string) (string, error) {
-	var lines []string
-	file, err := os.Open("/proc/mounts")
+func GetRunningContainers() ([]RunningContainerInfo, error) {
+	var containers []RunningContainerInfo
+	states, err := container.GetAccessor().ListStates()
 	if err != nil {
-		fmt.Println("Unable to read /proc/mounts")
-		return "", err
-	}
-	defer func() {
-		_ = file.Close()
-	}()
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+		return nil, err
 	}
-
-	accessor := image.GetAccessor()
-
-	for _, line := range lines {
-		if strings.Contains(line, containerID) {
-			parts := strings.Split(line, " ")
-			for _, part := range parts {
-				if strings.Contains(part, "lowerdir=") {
-					options := strings.Split(part, ",")
-					for _, option := range options {
-						if strings.Contains(option, "lowerdir=") {
-							imagesPath := workdirs.ImagesPath()
-							leaderString := "lowerdir=" + imagesPath + "/"
-							trailerString := option[len(leaderString):]
-							imageID := trailerString[:12]
-							img, tag := accessor.GetImageAndTagByHash(imageID)
-							return fmt.Sprintf("%s:%s", img, tag), nil
-						}
-					}
-				}
-			}
+	/* Containers can live in different cgroup parents, so they are found through their state */
+	for _, state := range states {
+		if !state.IsRunning() {
+			continue
+		}
+		container, _ := getRunningContainerInfoForId(state.CGroups(), state.ID, state.Image)
+		if container.PID > 0 {
+			containers = append(containers, container)
 		}
 	}
-	return "", nil
+	return containers, nil
 }
 
-func getRunningContainerInfoForId(containerID string) (RunningContainerInfo, error) {
+func getRunningContainerInfoForId(cGroupsAccessor cgroups.Accessor, containerID string, imageID string) (RunningContainerInfo, error) {
 	container := RunningContainerInfo{}
-	var procs []string
-	basePath := "/sys/fs/cgroup/cpu/fdocker"
-
-	file, err := os.Open(basePath + "/" + containerID + "/cgroup.procs")
+	procs, err := cGroupsAccessor.GetProcs(containerID)
 	if err != nil {
 		fmt.Println("Unable to read cgroup.procs")
 		return container, err
 	}
-	defer func() {
-		_ = file.Close()
-	}()
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		procs = append(procs, scanner.Text())
-	}
 	if len(procs) > 0 {
-		pid, err := strconv.Atoi(procs[len(procs)-1])
-		if err != nil {
-			fmt.Println("Unable to read PID")
-			return container, err
-		}
+		pid := procs[len(procs)-1]
 		cmd, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/exe")
 		containerMntPath := workdirs.ContainersPath() + "/" + containerID + "/fs/mnt"
 		realContainerMntPath, err := filepath.EvalSymlinks(containerMntPath)
@@ -150,10 +95,15 @@ func getRunningContainerInfoForId(containerID string) (RunningContainerInfo, err
 			fmt.Println("Unable to read Command link.")
 			return container, err
 		}
-		img, _ := getDistribution(containerID)
+		img, tag := image.GetAccessor().GetImageAndTagByHash(imageID)
+		separator := ":"
+		if strings.HasPrefix(tag, "sha256:") {
+			separator = "@"
+		}
 		container = RunningContainerInfo{
 			ContainerId: containerID,
-			Image:       img,
+			ImageID:     imageID,
+			Image:       img + separator + tag,
 			Command:     cmd[len(realContainerMntPath):],
 			PID:         pid,
 		}
@@ -161,22 +111,6 @@ func getRunningContainerInfoForId(containerID string) (RunningContainerInfo, err
 	return container, nil
 }
 
-/*
-		Get the list of running container IDs.
-
-		Implementation logic:
-		- Fdocker creates multiple folders in the /sys/fs/cgroup hierarchy
-		- For example, for setting cpu limits, fdocker uses /sys/fs/cgroup/cpu/fdocker
-	- Inside that folder are folders one each for currently running containers
-	- Those folder names are the container IDs we create.
-	- getContainerInfoForId() does more work. It gathers more information about running
-		containers. See struct RunningContainerInfo for details.
-	- Inside each of those folders is a "cgroup.procs" file that has the list
-		of PIDs of processes inside of that container. From the PID, we can
-		get the mounted path from which the process was started. From that
-		mounted path, we can get the Image of the containers since containers
-		are mounted via the overlay file system.
-*/
 func printRunningContainers() {
 	containers, err := GetRunningContainers()
 	if err != nil {
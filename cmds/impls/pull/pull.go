@@ -0,0 +1,55 @@
+package pull
+
+import (
+	"fdocker/image"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+	"strings"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "pull"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker pull [--all-tags] [--insecure] <image>"
+}
+
+func (e Executor) Exec() {
+	fs := flag.FlagSet{}
+	allTags := fs.BoolP("all-tags", "a", false, "Pull all tags of the repository")
+	insecure := fs.Bool("insecure", false, "Talk plain HTTP to the registry")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	if fs.NArg() != 1 {
+		log.Fatalf("Please pass the image to pull")
+	}
+	ref, err := image.ParseReference(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	accessor := image.GetAccessor()
+	accessor.Insecure = *insecure
+	if *allTags {
+		src := fs.Arg(0)
+		if strings.Contains(src, "@") || strings.LastIndex(src, ":") > strings.LastIndex(src, "/") {
+			log.Fatalf("A tag or digest can not be used with --all-tags")
+		}
+		accessor.PullAllTags(ref)
+		return
+	}
+	accessor.PullImage(ref)
+}
@@ -0,0 +1,53 @@
+package push
+
+import (
+	"fdocker/image"
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "push"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker push [--insecure] <repository:tag>"
+}
+
+func (e Executor) Exec() {
+	fs := flag.FlagSet{}
+	insecure := fs.Bool("insecure", false, "Talk plain HTTP to the registry")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	if fs.NArg() != 1 {
+		log.Fatalf("Please pass the image to push")
+	}
+	src := fs.Arg(0)
+	accessor := image.GetAccessor()
+	accessor.Insecure = *insecure
+	imageShaHex, ok := accessor.FindImage(src)
+	if !ok {
+		log.Fatalf("No such image: %s", src)
+	}
+	ref, err := image.ParseReference(src)
+	if err != nil || imageShaHex == src || len(ref.Tag) == 0 {
+		log.Fatalf("Please pass the image as <repository:tag>, it is pushed to that repository")
+	}
+	fmt.Printf("The push refers to repository [%s]\n", ref.Repository())
+	digest := accessor.PushImage(imageShaHex, ref)
+	fmt.Printf("%s: digest: %s\n", ref.Tag, digest)
+}
@@ -0,0 +1,47 @@
+package registrycmd
+
+import (
+	"fdocker/registry"
+	"fdocker/workdirs"
+	flag "github.com/spf13/pflag"
+	"log"
+	"net/http"
+	"os"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "registry"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker registry serve [--addr <host:port>] [--root <dir>]"
+}
+
+func (e Executor) Exec() {
+	if len(os.Args) < 3 || os.Args[2] != "serve" {
+		log.Fatalf("Usage: %s", e.Usage())
+	}
+	fs := flag.FlagSet{}
+	addr := fs.String("addr", "127.0.0.1:5000", "Address to listen on")
+	root := fs.String("root", workdirs.RegistryPath(), "Directory to keep the images in")
+	if err := fs.Parse(os.Args[3:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	reg, err := registry.New(*root)
+	if err != nil {
+		log.Fatalf("Unable to set up registry in %s: %v\n", *root, err)
+	}
+	log.Printf("Serving registry from %s on %s\n", *root, *addr)
+	log.Fatal(http.ListenAndServe(*addr, reg))
+}
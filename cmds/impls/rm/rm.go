@@ -0,0 +1,43 @@
+package rm
+
+import (
+	"fdocker/container"
+	"fdocker/events"
+	"fdocker/utils"
+	"log"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "rm"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker rm <container-id>"
+}
+
+func (e Executor) Exec() {
+	containerID := utils.ParseSingleArg("Please pass container ID to remove")
+	accessor := container.GetAccessor()
+	state, err := accessor.LoadState(containerID)
+	if err != nil {
+		log.Fatalf("No such container: %s", containerID)
+	}
+	if state.IsRunning() {
+		log.Fatalf("Cannot remove container %s because it is running", containerID)
+	}
+	utils.MustWithMsg(accessor.RemoveContainer(containerID), "Unable to remove container")
+	if err := events.GetAccessor().Emit(events.TypeDestroy, containerID, nil); err != nil {
+		log.Printf("Warning: unable to record destroy event: %v\n", err)
+	}
+}
@@ -1,7 +1,7 @@
 package rmi
 
 import (
-	"fdocker/cmds/impls/ps"
+	"fdocker/container"
 	"fdocker/image"
 	"fdocker/utils"
 	"log"
@@ -33,18 +33,18 @@ func (e Executor) Exec() {
 
 func DeleteImageByHash(imageShaHex string) {
 	accessor := image.GetAccessor()
-	imgName, imgTag := accessor.GetImageAndTagByHash(imageShaHex)
+	imgName, _ := accessor.GetImageAndTagByHash(imageShaHex)
 	if len(imgName) == 0 {
 		log.Fatalf("No such image")
 	}
-	containers, err := ps.GetRunningContainers()
+	/* Stopped containers still mount the layers of their image on a restart, diff and cp */
+	states, err := container.GetAccessor().ListStates()
 	if err != nil {
-		log.Fatalf("Unable to get running containers list: %v\n", err)
+		log.Fatalf("Unable to get containers list: %v\n", err)
 	}
-	for _, container := range containers {
-		if container.Image == imgName+":"+imgTag {
-			log.Fatalf("Cannot delete image becuase it is in use by: %s",
-				container.ContainerId)
+	for _, state := range states {
+		if state.Image == imageShaHex {
+			log.Fatalf("Cannot delete image because it is in use by: %s", state.ID)
 		}
 	}
 	accessor.DeleteImageByHash(imageShaHex)
@@ -2,6 +2,9 @@ package run
 
 import (
 	"fdocker/cgroups"
+	"fdocker/config"
+	"fdocker/container"
+	"fdocker/events"
 	"fdocker/image"
 	"fdocker/network"
 	"fdocker/utils"
@@ -9,6 +12,7 @@ import (
 	"fmt"
 	flag "github.com/spf13/pflag"
 	"golang.org/x/sys/unix"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
@@ -17,8 +21,12 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
+/* How often the number of processes of a running container is sampled */
+const pidsSampleInterval = 100 * time.Millisecond
+
 type Executor struct {
 }
 
@@ -35,7 +43,10 @@ func (e Executor) Implicit() bool {
 }
 
 func (e Executor) Usage() string {
-	return "f-docker run [--mem] [--swap] [--pids] [--cpus] <image> <command>"
+	return "f-docker run [--rm] [--stats-on-exit] [--cgroup-parent] [--mem] [--swap] [--memory-reservation] [--memory-swappiness] " +
+		"[--kernel-memory] [--oom-kill-disable] [--oom-score-adj] [--pids] [--cpus] [--cpuset-cpus] [--cpuset-mems] " +
+		"[--cpu-shares|--cpu-weight] [--cpu-period] [--cpu-quota] [--blkio-weight] " +
+		"[--device-{read,write}-{bps,iops}] [--device] [--hugetlb] [--ulimit] [-e] [--entrypoint] <image> [command...]"
 }
 
 func (e Executor) Exec() {
@@ -45,36 +56,115 @@ func (e Executor) Exec() {
 }
 
 type runArgs struct {
-	mem       int
-	swap      int
-	pids      int
-	cpus      float64
-	imageName string
-	commands  []string
+	rm           bool
+	statsOnExit  bool
+	resources    cgroups.Resources
+	cgroupParent string
+	ulimits      []container.Ulimit
+	oomScoreAdj  int
+	imageName    string
+	commands     []string
+	env          []string
+	/* nil unless --entrypoint was passed, an empty one clears the image's */
+	entrypoint *string
 }
 
 func parseFlags() *runArgs {
 	fs := flag.FlagSet{}
 	fs.ParseErrorsWhitelist.UnknownFlags = true
 
-	mem := fs.Int("mem", -1, "Max RAM to allow in MB")
-	swap := fs.Int("swap", -1, "Max swap to allow in MB")
-	pids := fs.Int("pids", -1, "Number of max processes to allow")
-	cpus := fs.Float64("cpus", -1, "Number of CPU cores to restrict to")
+	rm := fs.Bool("rm", false, "Automatically remove the container when it exits")
+	statsOnExit := fs.Bool("stats-on-exit", false, "Print the resource usage of the container when it exits")
+	oomScoreAdj := fs.Int("oom-score-adj", 0, "Tune host's OOM preferences (-1000 to 1000)")
+	cgroupParent := fs.String("cgroup-parent", "", "Parent cgroup for the container, shared limits of the parent apply")
+	res := cgroups.NewResources()
+	cgroups.AddResourceFlags(&fs, &res)
+	cgroups.AddDeviceFlag(&fs, &res)
+	var ulimits []container.Ulimit
+	container.AddUlimitFlag(&fs, &ulimits)
+	env := fs.StringArrayP("env", "e", nil, "Set an environment variable, NAME=VALUE or NAME to pass it on")
+	entrypoint := fs.String("entrypoint", "", "Overwrite the default entrypoint of the image")
+	/* Flags after the image belong to the command */
+	fs.SetInterspersed(false)
 	if err := fs.Parse(os.Args[2:]); err != nil {
 		fmt.Println("Error parsing: ", err)
 	}
-	if len(fs.Args()) < 2 {
-		log.Fatalf("Please pass image name and command to run")
+	if len(fs.Args()) < 1 {
+		log.Fatalf("Please pass image name to run")
+	}
+	if err := cgroups.GetAccessor().ValidateResources(res); err != nil {
+		log.Fatalf("Invalid resource limits: %v\n", err)
+	}
+	if *oomScoreAdj < -1000 || *oomScoreAdj > 1000 {
+		log.Fatalf("Invalid --oom-score-adj %d, must be between -1000 and 1000\n", *oomScoreAdj)
+	}
+	if res.OomKillDisable && res.Memory < 0 {
+		log.Println("Warning: disabling the OOM killer without a memory limit may hang the host")
+	}
+	if !fs.Changed("entrypoint") {
+		entrypoint = nil
 	}
 	return &runArgs{
-		mem:       *mem,
-		swap:      *swap,
-		pids:      *pids,
-		cpus:      *cpus,
-		imageName: fs.Args()[0],
-		commands:  fs.Args()[1:],
+		rm:           *rm,
+		statsOnExit:  *statsOnExit,
+		oomScoreAdj:  *oomScoreAdj,
+		resources:    res,
+		cgroupParent: cgroups.GetAccessor().WithParent(*cgroupParent).Parent(),
+		ulimits:      container.MergeUlimits(defaultUlimits(), ulimits),
+		imageName:    fs.Args()[0],
+		commands:     fs.Args()[1:],
+		env:          hostEnv(*env),
+		entrypoint:   entrypoint,
+	}
+}
+
+/* Like docker, -e NAME passes the variable of the host on if it is set */
+func hostEnv(env []string) []string {
+	var resolved []string
+	for _, variable := range env {
+		if strings.Contains(variable, "=") {
+			resolved = append(resolved, variable)
+		} else if value, ok := os.LookupEnv(variable); ok {
+			resolved = append(resolved, variable+"="+value)
+		}
+	}
+	return resolved
+}
+
+/*
+	Computes the command of the container like docker: the entrypoint of
+	the image followed by the command passed to run, or by the Cmd of the
+	image if there is none. Overriding the entrypoint drops the Cmd of the
+	image as well.
+*/
+func containerCommand(imgConfig image.ConfigDetails, args *runArgs) []string {
+	entrypoint, cmd := imgConfig.Entrypoint, imgConfig.Cmd
+	if args.entrypoint != nil {
+		entrypoint, cmd = nil, nil
+		if len(*args.entrypoint) > 0 {
+			entrypoint = []string{*args.entrypoint}
+		}
+	}
+	if len(args.commands) > 0 {
+		cmd = args.commands
+	}
+	return append(append([]string{}, entrypoint...), cmd...)
+}
+
+func defaultUlimits() []container.Ulimit {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Unable to load config: %v\n", err)
+	}
+	var ulimits []container.Ulimit
+	for _, value := range cfg.DefaultUlimits {
+		ulimit, err := container.ParseUlimit(value)
+		if err != nil {
+			log.Fatalf("Invalid default ulimit in config: %v\n", err)
+		}
+		ulimits = append(ulimits, ulimit)
 	}
+	return ulimits
 }
 
 func setUpBridge() {
@@ -97,43 +187,20 @@ func createContainerID() string {
 		randBytes[3], randBytes[4], randBytes[5])
 }
 
-func getContainerMntPath(containerID string) string {
-	return path.Join(workdirs.GetContainerFSHome(containerID), "mnt")
-}
-
-func getContainerUpperDirPath(containerID string) string {
-	return path.Join(workdirs.GetContainerFSHome(containerID), "upperdir")
-}
-
-func getContainerWorkDirPath(containerID string) string {
-	return path.Join(workdirs.GetContainerFSHome(containerID), "workdir")
-}
-
 func createContainerDirectories(containerID string) {
 	contDirs := []string{
 		workdirs.GetContainerFSHome(containerID),
-		getContainerMntPath(containerID),
-		getContainerUpperDirPath(containerID),
-		getContainerWorkDirPath(containerID)}
+		workdirs.GetContainerMntPath(containerID),
+		workdirs.GetContainerUpperDirPath(containerID),
+		workdirs.GetContainerWorkDirPath(containerID)}
 	if err := utils.EnsureDirs(contDirs); err != nil {
 		log.Fatalf("Unable to create required directories: %v\n", err)
 	}
 }
 
 func mountOverlayFileSystem(containerID string, imageShaHex string) {
-	var srcLayers []string
-	accessor := image.GetAccessor()
-	pathManifest := accessor.GetManifestPathForImage(imageShaHex)
-	mani := accessor.ParseManifest(pathManifest)
-	imageBasePath := accessor.GetBasePathForImage(imageShaHex)
-	for _, layer := range mani.Layers {
-		srcLayers = append([]string{imageBasePath + "/" + layer[:12] + "/fs"}, srcLayers...)
-	}
-	contFSHome := workdirs.GetContainerFSHome(containerID)
-	mntOptions := "lowerdir=" + strings.Join(srcLayers, ":") + ",upperdir=" + contFSHome + "/upperdir,workdir=" + contFSHome + "/workdir"
-	//log.Printf("mntOptions=[%s]", mntOptions)
-	//log.Printf("contFSHome mnt=[%s]", contFSHome+"/mnt")
-	if err := unix.Mount("none", contFSHome+"/mnt", "overlay", 0, mntOptions); err != nil {
+	accessor := container.GetAccessor()
+	if err := accessor.MountOverlay(containerID, imageShaHex, workdirs.GetContainerMntPath(containerID)); err != nil {
 		log.Fatalf("Mount failed: %v\n", err)
 	}
 }
@@ -151,8 +218,10 @@ func unmountContainerFs(containerID string) {
 	}
 }
 
-func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
-	containerID string, imageShaHex string, cmdArgs []string) {
+/*
+	Runs the container command through child-mode and returns its exit code.
+*/
+func prepareAndExecuteContainer(runArgs *runArgs, containerID string) int {
 
 	/*
 		From namespaces(7)
@@ -171,24 +240,7 @@ func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
 		       UTS       CLONE_NEWUTS    Hostname and NIS
 		                                 domain name
 	*/
-	var opts []string
-	if mem > 0 {
-		opts = append(opts, "--mem="+strconv.Itoa(mem))
-	}
-	if swap >= 0 {
-		opts = append(opts, "--swap="+strconv.Itoa(swap))
-	}
-	if pids > 0 {
-		opts = append(opts, "--pids="+strconv.Itoa(pids))
-	}
-	if cpus > 0 {
-		opts = append(opts, "--cpus="+strconv.FormatFloat(cpus, 'f', 1, 64))
-	}
-	opts = append(opts, "--img="+imageShaHex)
-	args := append([]string{containerID}, cmdArgs...)
-	args = append(opts, args...)
-	args = append([]string{"child-mode"}, args...)
-	cmd := exec.Command("/proc/self/exe", args...)
+	cmd := exec.Command("/proc/self/exe", "child-mode", containerID)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -199,20 +251,8 @@ func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
 			unix.CLONE_NEWUSER |
 			unix.CLONE_NEWNET |
 			unix.CLONE_NEWIPC,
-		UidMappings: []syscall.SysProcIDMap{
-			{
-				ContainerID: 0,
-				HostID:      syscall.Getuid(),
-				Size:        1,
-			},
-		},
-		GidMappings: []syscall.SysProcIDMap{
-			{
-				ContainerID: 0,
-				HostID:      syscall.Getgid(),
-				Size:        1,
-			},
-		},
+		UidMappings: idMappings(syscall.Getuid()),
+		GidMappings: idMappings(syscall.Getgid()),
 		Credential: &syscall.Credential{
 			Uid: uint32(syscall.Getuid()),
 			Gid: uint32(syscall.Getgid()),
@@ -225,6 +265,16 @@ func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
 	utils.Must(cmd.Start())
 
 	pid := cmd.Process.Pid
+	recordContainerStarted(containerID, pid)
+	/*
+		Set from the host side, since lowering the score needs
+		CAP_SYS_RESOURCE in the initial user namespace. The command run
+		by child-mode inherits it.
+	*/
+	if runArgs.oomScoreAdj != 0 {
+		utils.MustWithMsg(ioutil.WriteFile(fmt.Sprintf("/proc/%d/oom_score_adj", pid),
+			[]byte(strconv.Itoa(runArgs.oomScoreAdj)), 0644), "Unable to set oom_score_adj")
+	}
 
 	setupvethcmd := &exec.Cmd{
 		Path:   "/proc/self/exe",
@@ -235,28 +285,248 @@ func prepareAndExecuteContainer(mem int, swap int, pids int, cpus float64,
 
 	utils.Must(setupvethcmd.Run())
 
-	utils.Must(cmd.Wait())
+	exitCode, err := utils.ExitCode(cmd.Wait())
+	utils.MustWithMsg(err, "Unable to wait for container")
+	return exitCode
+}
+
+/*
+	Maps the IDs of the container to the same IDs on the host, so files of
+	other users in the image keep their owners and the command can switch
+	to the user of the image. Without root only the own ID can be mapped.
+*/
+func idMappings(hostID int) []syscall.SysProcIDMap {
+	size := 1
+	if hostID == 0 {
+		size = 65536
+	}
+	return []syscall.SysProcIDMap{
+		{
+			ContainerID: 0,
+			HostID:      hostID,
+			Size:        size,
+		},
+	}
+}
+
+/*
+	Watches the memory cgroup of a container for OOM kills while it runs and
+	emits an oom event for each of them. The returned function stops
+	watching and returns the number of kills seen.
+*/
+func watchOOM(cGroupsAccessor cgroups.Accessor, containerID string) func() int64 {
+	notifier, err := cGroupsAccessor.NotifyOOM(containerID)
+	if err != nil {
+		log.Printf("Warning: unable to watch container for OOM kills: %v\n", err)
+		return func() int64 { return 0 }
+	}
+	done := make(chan int64)
+	go func() {
+		var kills int64
+		for range notifier.Events {
+			kills++
+			emitEvent(events.TypeOOM, containerID, nil)
+		}
+		done <- kills
+	}()
+	return func() int64 {
+		notifier.Close()
+		return <-done
+	}
+}
+
+/*
+	Samples the number of processes of a container while it runs, for
+	kernels that lack pids.peak. The returned function stops sampling and
+	returns the highest number seen.
+*/
+func watchPids(cGroupsAccessor cgroups.Accessor, containerID string) func() int64 {
+	stop := make(chan struct{})
+	done := make(chan int64)
+	go func() {
+		var peak int64
+		ticker := time.NewTicker(pidsSampleInterval)
+		defer ticker.Stop()
+		for {
+			if stats, err := cGroupsAccessor.GetStats(containerID); err == nil && stats.Pids > peak {
+				peak = stats.Pids
+			}
+			select {
+			case <-stop:
+				done <- peak
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() int64 {
+		close(stop)
+		return <-done
+	}
+}
+
+func emitEvent(eventType string, containerID string, attributes map[string]string) {
+	if err := events.GetAccessor().Emit(eventType, containerID, attributes); err != nil {
+		log.Printf("Warning: unable to record %s event: %v\n", eventType, err)
+	}
+}
+
+func recordContainerStarted(containerID string, pid int) {
+	accessor := container.GetAccessor()
+	state, err := accessor.LoadState(containerID)
+	utils.MustWithMsg(err, "Unable to load container state")
+	state.Pid = pid
+	state.Status = container.StatusRunning
+	state.StartedAt = time.Now()
+	utils.MustWithMsg(accessor.SaveState(state), "Unable to save container state")
+	emitEvent(events.TypeStart, containerID, map[string]string{"image": state.ImageName})
+}
+
+/*
+	Must be called before the cgroups of the container are removed, the CPU
+	times, peak usages and the OOM kill counter are read from them. The
+	counter catches kills the watcher missed because the container exited
+	first. usage holds what was collected outside of the cgroups.
+*/
+func recordContainerExited(containerID string, exitCode int, usage container.Usage) *container.State {
+	accessor := container.GetAccessor()
+	state, err := accessor.LoadState(containerID)
+	utils.MustWithMsg(err, "Unable to load container state")
+	state.Pid = 0
+	state.Status = container.StatusExited
+	state.FinishedAt = time.Now()
+	state.ExitCode = exitCode
+	usage.WallTime = state.FinishedAt.Sub(state.StartedAt)
+	if stats, err := state.CGroups().GetStats(containerID); err != nil {
+		log.Printf("Warning: unable to read final cgroup stats: %v\n", err)
+	} else {
+		usage.CpuUser = time.Duration(stats.CpuUser)
+		usage.CpuSystem = time.Duration(stats.CpuSystem)
+		usage.MemoryPeak = stats.MemoryMaxUsage
+		if stats.PidsPeak > usage.PidsPeak {
+			usage.PidsPeak = stats.PidsPeak
+		}
+		if stats.OomKills > usage.OomKills {
+			if usage.OomKills == 0 {
+				emitEvent(events.TypeOOM, containerID, nil)
+			}
+			usage.OomKills = stats.OomKills
+		}
+	}
+	state.OOMKilled = usage.OomKills > 0
+	state.Usage = &usage
+	utils.MustWithMsg(accessor.SaveState(state), "Unable to save container state")
+	if state.OOMKilled {
+		log.Printf("Container %s ran out of memory and was OOM-killed by the kernel "+
+			"(memory limit: %s, peak usage: %s)\n", containerID,
+			formatMemoryLimit(state.Resources.Memory), formatBytes(usage.MemoryPeak))
+	}
+	emitEvent(events.TypeDie, containerID, map[string]string{
+		"exitCode":  strconv.Itoa(exitCode),
+		"oomKilled": strconv.FormatBool(state.OOMKilled),
+	})
+	return state
+}
+
+/* Printed to stderr, so that it does not mix with the output of the command */
+func printUsage(state *container.State) {
+	usage := state.Usage
+	fmt.Fprintf(os.Stderr, "Resource usage of container %s:\n", state.ID)
+	fmt.Fprintf(os.Stderr, "  wall time:    %.3fs\n", usage.WallTime.Seconds())
+	fmt.Fprintf(os.Stderr, "  cpu user:     %.3fs\n", usage.CpuUser.Seconds())
+	fmt.Fprintf(os.Stderr, "  cpu system:   %.3fs\n", usage.CpuSystem.Seconds())
+	fmt.Fprintf(os.Stderr, "  peak memory:  %s\n", formatBytes(usage.MemoryPeak))
+	fmt.Fprintf(os.Stderr, "  max pids:     %d\n", usage.PidsPeak)
+	fmt.Fprintf(os.Stderr, "  oom kills:    %d\n", usage.OomKills)
+	fmt.Fprintf(os.Stderr, "  network in:   %d bytes\n", usage.NetRxBytes)
+	fmt.Fprintf(os.Stderr, "  network out:  %d bytes\n", usage.NetTxBytes)
+}
+
+func formatMemoryLimit(memory int) string {
+	if memory < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%dMB", memory)
+}
+
+func formatBytes(bytes int64) string {
+	return fmt.Sprintf("%.1fMB", float64(bytes)/1024/1024)
 }
 
 func initContainer(args *runArgs) {
-	mem, swap, pids, cpus, src, cmds := args.mem, args.swap, args.pids, args.cpus, args.imageName, args.commands
+	src := args.imageName
 	containerID := createContainerID()
 	log.Printf("New container ID: %s\n", containerID)
 	imgAccessor := image.GetAccessor()
 	netAccessor := network.GetAccessor()
-	cGroupsAccessor := cgroups.GetAccessor()
+	cGroupsAccessor := cgroups.GetAccessor().WithParent(args.cgroupParent)
 	imageShaHex := imgAccessor.DownloadImageIfRequired(src)
 	log.Printf("Image to overlay mount: %s\n", imageShaHex)
+	imgConfig := imgAccessor.ParseContainerConfig(imageShaHex).Config
+	cmds := containerCommand(imgConfig, args)
+	if len(cmds) == 0 {
+		log.Fatalf("No command specified, the image has neither an entrypoint nor a command")
+	}
+	env := container.MergeEnv(imgConfig.Env, args.env)
+	if _, ok := container.LookupEnv(env, "PATH"); !ok {
+		env = append(env, "PATH="+container.DefaultPath)
+	}
+	stopSignal := imgConfig.StopSignal
+	if len(stopSignal) == 0 {
+		stopSignal = container.DefaultStopSignal
+	} else if _, err := container.ParseSignal(stopSignal); err != nil {
+		log.Fatalf("Invalid stop signal of image: %v\n", err)
+	}
 	createContainerDirectories(containerID)
+	utils.MustWithMsg(container.GetAccessor().SaveState(&container.State{
+		ID:           containerID,
+		Image:        imageShaHex,
+		ImageName:    src,
+		Command:      cmds,
+		Env:          env,
+		WorkingDir:   imgConfig.WorkingDir,
+		User:         imgConfig.User,
+		StopSignal:   stopSignal,
+		Resources:    args.resources,
+		CgroupParent: args.cgroupParent,
+		Ulimits:      args.ulimits,
+		OomScoreAdj:  args.oomScoreAdj,
+		Status:       container.StatusCreated,
+		CreatedAt:    time.Now(),
+	}), "Unable to save container state")
 	mountOverlayFileSystem(containerID, imageShaHex)
 	// Network Step2: set up virtual eth connecting from f-docker bridge on host to another virtual eth
 	if err := netAccessor.SetupVirtualEthOnHost(containerID); err != nil {
 		log.Fatalf("Unable to setup Veth0 on host: %v", err)
 	}
-	prepareAndExecuteContainer(mem, swap, pids, cpus, containerID, imageShaHex, cmds)
+	/*
+		The cgroups are set up before the container starts, so that the
+		OOM watcher is in place before the command can allocate memory.
+	*/
+	utils.MustWithMsg(cGroupsAccessor.CreateCGroups(containerID), "Unable to create cgroups")
+	utils.MustWithMsg(cGroupsAccessor.ConfigureCGroups(containerID, args.resources), "Unable to configure cgroups")
+	for _, ulimit := range args.ulimits {
+		utils.MustWithMsg(ulimit.RaiseHardLimit(), "Unable to raise hard limit of "+ulimit.Name)
+	}
+	stopOOMWatch := watchOOM(cGroupsAccessor, containerID)
+	stopPidsWatch := watchPids(cGroupsAccessor, containerID)
+	exitCode := prepareAndExecuteContainer(args, containerID)
 	log.Printf("Container done.\n")
+	usage := container.Usage{OomKills: stopOOMWatch(), PidsPeak: stopPidsWatch()}
+	var err error
+	if usage.NetRxBytes, usage.NetTxBytes, err = netAccessor.GetVethStats(containerID); err != nil {
+		log.Printf("Warning: unable to read network stats: %v\n", err)
+	}
 	unmountNetworkNamespace(containerID)
 	unmountContainerFs(containerID)
-	cGroupsAccessor.RemoveCGroups(containerID)
-	_ = os.RemoveAll(workdirs.ContainersPath() + "/" + containerID)
+	state := recordContainerExited(containerID, exitCode, usage)
+	if args.statsOnExit {
+		printUsage(state)
+	}
+	utils.MustWithMsg(cGroupsAccessor.RemoveCGroups(containerID), "Unable to remove cgroup dir")
+	if args.rm {
+		_ = container.GetAccessor().RemoveContainer(containerID)
+		emitEvent(events.TypeDestroy, containerID, nil)
+	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,55 @@
+package save
+
+import (
+	"fdocker/image"
+	flag "github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "save"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker save [-o <file>] [--format docker|oci] <image>..."
+}
+
+func (e Executor) Exec() {
+	fs := flag.FlagSet{}
+	output := fs.StringP("output", "o", "", "Write to a file instead of stdout")
+	format := fs.String("format", image.DockerArchiveFormat, "Archive format, docker or oci")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	if *format != image.DockerArchiveFormat && *format != image.OCIArchiveFormat {
+		log.Fatalf("Unknown format %s, use docker or oci", *format)
+	}
+	if fs.NArg() < 1 {
+		log.Fatalf("Please pass the images to save")
+	}
+	out := os.Stdout
+	if len(*output) > 0 {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Unable to create %s: %v\n", *output, err)
+		}
+		defer f.Close()
+		out = f
+	} else if _, err := unix.IoctlGetTermios(int(out.Fd()), unix.TCGETS); err == nil {
+		log.Fatalf("Refusing to write the archive to a terminal, use -o or redirect stdout")
+	}
+	image.GetAccessor().SaveImages(out, fs.Args(), *format)
+}
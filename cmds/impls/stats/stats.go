@@ -0,0 +1,125 @@
+package stats
+
+import (
+	"fdocker/cgroups"
+	"fdocker/container"
+	"fdocker/cmds/impls/ps"
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/* CPU usage is averaged over this interval between two samples */
+const sampleInterval = time.Second
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "stats"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker stats [container-id...]"
+}
+
+func (e Executor) Exec() {
+	fs := flag.FlagSet{}
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	containerIDs := fs.Args()
+	if len(containerIDs) == 0 {
+		containers, err := ps.GetRunningContainers()
+		if err != nil {
+			log.Fatalf("Unable to get running containers list: %v\n", err)
+		}
+		for _, container := range containers {
+			containerIDs = append(containerIDs, container.ContainerId)
+		}
+	}
+	printStats(containerIDs)
+}
+
+func printStats(containerIDs []string) {
+	accessors := make(map[string]cgroups.Accessor)
+	for _, containerID := range containerIDs {
+		state, err := container.GetAccessor().LoadState(containerID)
+		if err != nil {
+			log.Fatalf("No such container: %s\n", containerID)
+		}
+		accessors[containerID] = state.CGroups()
+	}
+	first := make(map[string]*cgroups.Stats)
+	for _, containerID := range containerIDs {
+		stats, err := accessors[containerID].GetStats(containerID)
+		if err != nil {
+			log.Fatalf("Unable to read stats of container %s: %v\n", containerID, err)
+		}
+		first[containerID] = stats
+	}
+	time.Sleep(sampleInterval)
+
+	fmt.Println("CONTAINER ID\tCPU %\tMEM USAGE / LIMIT\tBLOCK I/O\tPIDS\tPRESSURE CPU/MEM/IO\tMEM HIGH/MAX/OOM")
+	for _, containerID := range containerIDs {
+		stats, err := accessors[containerID].GetStats(containerID)
+		if err != nil {
+			log.Fatalf("Unable to read stats of container %s: %v\n", containerID, err)
+		}
+		cpuPercent := float64(stats.CpuUsage-first[containerID].CpuUsage) /
+			float64(sampleInterval.Nanoseconds()) * 100
+		fmt.Printf("%s\t%.2f%%\t%s / %s\t%s / %s\t%d\t%s\t%s\n", containerID, cpuPercent,
+			formatBytes(stats.MemoryUsage), formatBytes(stats.MemoryLimit),
+			formatBytes(int64(stats.IoReadBytes)), formatBytes(int64(stats.IoWriteBytes)), stats.Pids,
+			formatPressures(stats), formatMemoryEvents(stats.MemoryEvents))
+	}
+}
+
+/*
+	Pressure is shown as the share of time at least one task of the
+	container was stalled during the last 10 seconds. A container that is
+	slow without any pressure is not being throttled.
+*/
+func formatPressures(stats *cgroups.Stats) string {
+	pressures := []*cgroups.Pressure{stats.CpuPressure, stats.MemoryPressure, stats.IoPressure}
+	values := make([]string, len(pressures))
+	for i, pressure := range pressures {
+		if pressure == nil {
+			values[i] = "-"
+		} else {
+			values[i] = fmt.Sprintf("%.2f%%", pressure.Some.Avg10)
+		}
+	}
+	return strings.Join(values, " / ")
+}
+
+func formatMemoryEvents(events *cgroups.MemoryEvents) string {
+	if events == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d / %d / %d", events.High, events.Max, events.Oom)
+}
+
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes < 0:
+		return "unlimited"
+	case bytes >= 1024*1024*1024:
+		return fmt.Sprintf("%.2fGiB", float64(bytes)/(1024*1024*1024))
+	case bytes >= 1024*1024:
+		return fmt.Sprintf("%.2fMiB", float64(bytes)/(1024*1024))
+	default:
+		return fmt.Sprintf("%.2fKiB", float64(bytes)/1024)
+	}
+}
@@ -0,0 +1,246 @@
+package update
+
+import (
+	"fdocker/cgroups"
+	"fdocker/container"
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type Executor struct {
+}
+
+func New() Executor {
+	return Executor{}
+}
+
+func (e Executor) CmdName() string {
+	return "update"
+}
+
+func (e Executor) Implicit() bool {
+	return false
+}
+
+func (e Executor) Usage() string {
+	return "f-docker update [--mem] [--swap] [--memory-reservation] [--memory-swappiness] " +
+		"[--kernel-memory] [--oom-kill-disable] [--pids] [--cpus] [--cpuset-cpus] [--cpuset-mems] " +
+		"[--cpu-shares|--cpu-weight] [--cpu-period] [--cpu-quota] [--blkio-weight] " +
+		"[--device-{read,write}-{bps,iops}] [--hugetlb] <container-id...|--cgroup-parent <parent>>"
+}
+
+func (e Executor) Exec() {
+	placeholder := cgroups.NewResources()
+	cgroupParent, containerIDs := parseFlags(&placeholder)
+	if len(cgroupParent) > 0 {
+		if len(containerIDs) > 0 {
+			log.Fatalf("--cgroup-parent updates a parent cgroup, no container ID can be given with it")
+		}
+		if err := updateParent(cgroupParent, placeholder); err != nil {
+			log.Fatalf("Unable to update cgroup parent %s: %v\n", cgroupParent, err)
+		}
+		return
+	}
+	if len(containerIDs) < 1 {
+		log.Fatalf("Please pass container ID to update")
+	}
+
+	failed := false
+	for _, containerID := range containerIDs {
+		state, err := container.GetAccessor().LoadState(containerID)
+		if err != nil {
+			log.Printf("No such container: %s\n", containerID)
+			failed = true
+			continue
+		}
+		/* Limits not given on the command line keep their stored value */
+		res := state.Resources
+		parseFlags(&res)
+		if err := updateContainer(state, res); err != nil {
+			log.Printf("Unable to update container %s: %v\n", containerID, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func parseFlags(res *cgroups.Resources) (string, []string) {
+	fs := flag.FlagSet{}
+	cgroups.AddResourceFlags(&fs, res)
+	cgroupParent := fs.String("cgroup-parent", "", "Update the shared limits of a parent cgroup instead of a container")
+	if err := fs.Parse(os.Args[2:]); err != nil {
+		log.Fatalf("Error parsing: %v\n", err)
+	}
+	return *cgroupParent, fs.Args()
+}
+
+/*
+	Limits set on a parent cgroup apply to all containers run with
+	--cgroup-parent <parent> together, on top of their own limits.
+*/
+func updateParent(cgroupParent string, res cgroups.Resources) error {
+	accessor := cgroups.GetAccessor().WithParent(cgroupParent)
+	if err := accessor.ConfigureParent(res); err != nil {
+		return err
+	}
+	for _, change := range describeChanges(cgroups.NewResources(), res) {
+		fmt.Printf("%s: %s\n", accessor.Parent(), change)
+	}
+	return nil
+}
+
+/*
+	Limits of a running container are applied to its cgroups right away.
+	Either way they are saved to the container state, so a stopped
+	container keeps the new limits on record.
+*/
+func updateContainer(state *container.State, res cgroups.Resources) error {
+	if err := res.Validate(); err != nil {
+		return err
+	}
+	changes := describeChanges(state.Resources, res)
+	if len(changes) == 0 {
+		fmt.Printf("%s: nothing changed\n", state.ID)
+		return nil
+	}
+	if state.IsRunning() {
+		accessor := state.CGroups()
+		if err := accessor.ValidateUpdate(state.ID, res); err != nil {
+			return err
+		}
+		if err := accessor.UpdateCGroups(state.ID, state.Resources, res); err != nil {
+			return err
+		}
+	}
+	state.Resources = res
+	if err := container.GetAccessor().SaveState(state); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Printf("%s: %s\n", state.ID, change)
+	}
+	return nil
+}
+
+func describeChanges(old cgroups.Resources, res cgroups.Resources) []string {
+	var changes []string
+	if old.Memory != res.Memory {
+		changes = append(changes, fmt.Sprintf("mem %s -> %s", formatLimit(old.Memory, "MB"), formatLimit(res.Memory, "MB")))
+	}
+	if old.Swap != res.Swap {
+		changes = append(changes, fmt.Sprintf("swap %s -> %s", formatLimit(old.Swap, "MB"), formatLimit(res.Swap, "MB")))
+	}
+	if old.MemoryReservation != res.MemoryReservation {
+		changes = append(changes, fmt.Sprintf("memory-reservation %s -> %s", formatOptional(old.MemoryReservation), formatOptional(res.MemoryReservation)))
+	}
+	if old.MemorySwappiness != res.MemorySwappiness {
+		changes = append(changes, fmt.Sprintf("memory-swappiness %s -> %s", formatLimit(old.MemorySwappiness, ""), formatLimit(res.MemorySwappiness, "")))
+	}
+	if old.KernelMemory != res.KernelMemory {
+		changes = append(changes, fmt.Sprintf("kernel-memory %s -> %s", formatOptional(old.KernelMemory), formatOptional(res.KernelMemory)))
+	}
+	if old.OomKillDisable != res.OomKillDisable {
+		changes = append(changes, fmt.Sprintf("oom-kill-disable %v -> %v", old.OomKillDisable, res.OomKillDisable))
+	}
+	if old.Pids != res.Pids {
+		changes = append(changes, fmt.Sprintf("pids %s -> %s", formatLimit(old.Pids, ""), formatLimit(res.Pids, "")))
+	}
+	if old.Cpus != res.Cpus {
+		changes = append(changes, fmt.Sprintf("cpus %s -> %s", formatCpus(old.Cpus), formatCpus(res.Cpus)))
+	}
+	if old.CpusetCpus != res.CpusetCpus {
+		changes = append(changes, fmt.Sprintf("cpuset-cpus %s -> %s", formatCpuset(old.CpusetCpus), formatCpuset(res.CpusetCpus)))
+	}
+	if old.CpusetMems != res.CpusetMems {
+		changes = append(changes, fmt.Sprintf("cpuset-mems %s -> %s", formatCpuset(old.CpusetMems), formatCpuset(res.CpusetMems)))
+	}
+	if old.CpuShares != res.CpuShares {
+		changes = append(changes, fmt.Sprintf("cpu-shares %s -> %s", formatOptional(old.CpuShares), formatOptional(res.CpuShares)))
+	}
+	if old.CpuWeight != res.CpuWeight {
+		changes = append(changes, fmt.Sprintf("cpu-weight %s -> %s", formatOptional(old.CpuWeight), formatOptional(res.CpuWeight)))
+	}
+	if old.CpuPeriod != res.CpuPeriod {
+		changes = append(changes, fmt.Sprintf("cpu-period %s -> %s", formatOptional(old.CpuPeriod), formatOptional(res.CpuPeriod)))
+	}
+	if old.CpuQuota != res.CpuQuota {
+		changes = append(changes, fmt.Sprintf("cpu-quota %s -> %s", formatOptional(old.CpuQuota), formatOptional(res.CpuQuota)))
+	}
+	if old.BlkioWeight != res.BlkioWeight {
+		changes = append(changes, fmt.Sprintf("blkio-weight %s -> %s", formatOptional(old.BlkioWeight), formatOptional(res.BlkioWeight)))
+	}
+	throttles := []struct {
+		name     string
+		old, res []cgroups.ThrottleDevice
+	}{
+		{"device-read-bps", old.DeviceReadBps, res.DeviceReadBps},
+		{"device-write-bps", old.DeviceWriteBps, res.DeviceWriteBps},
+		{"device-read-iops", old.DeviceReadIops, res.DeviceReadIops},
+		{"device-write-iops", old.DeviceWriteIops, res.DeviceWriteIops},
+	}
+	for _, throttle := range throttles {
+		if formatDevices(throttle.old) != formatDevices(throttle.res) {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", throttle.name, formatDevices(throttle.old), formatDevices(throttle.res)))
+		}
+	}
+	if formatHugetlb(old.HugetlbLimits) != formatHugetlb(res.HugetlbLimits) {
+		changes = append(changes, fmt.Sprintf("hugetlb %s -> %s", formatHugetlb(old.HugetlbLimits), formatHugetlb(res.HugetlbLimits)))
+	}
+	return changes
+}
+
+func formatLimit(value int, unit string) string {
+	if value < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d%s", value, unit)
+}
+
+func formatOptional(value int) string {
+	if value == 0 {
+		return "default"
+	}
+	return strconv.Itoa(value)
+}
+
+func formatDevices(devices []cgroups.ThrottleDevice) string {
+	if len(devices) == 0 {
+		return "none"
+	}
+	var values []string
+	for _, device := range devices {
+		values = append(values, device.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func formatHugetlb(limits []cgroups.HugetlbLimit) string {
+	if len(limits) == 0 {
+		return "none"
+	}
+	var values []string
+	for _, limit := range limits {
+		values = append(values, limit.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func formatCpus(cpus float64) string {
+	if cpus < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.2f", cpus)
+}
+
+func formatCpuset(cpus string) string {
+	if len(cpus) == 0 {
+		return "all"
+	}
+	return cpus
+}
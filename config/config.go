@@ -0,0 +1,34 @@
+package config
+
+import (
+	"encoding/json"
+	"fdocker/workdirs"
+	"io/ioutil"
+	"os"
+)
+
+/*
+	Config holds the host wide settings of f-docker, read from config.json
+	in the f-docker home directory:
+	{
+		"defaultUlimits": ["nofile=1024:4096", "memlock=-1"]
+	}
+	A missing file means all defaults.
+*/
+type Config struct {
+	DefaultUlimits []string `json:"defaultUlimits"`
+}
+
+func Load() (*Config, error) {
+	config := &Config{}
+	data, err := ioutil.ReadFile(workdirs.ConfigPath())
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,139 @@
+package container
+
+import (
+	"encoding/json"
+	"fdocker/cgroups"
+	"fdocker/image"
+	"fdocker/workdirs"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	StatusCreated = "created"
+	StatusRunning = "running"
+	StatusExited  = "exited"
+)
+
+/*
+	State is persisted as state.json under the container's home directory so
+	that commands other than run (diff, rm ...) can find out which image a
+	container was created from after it has exited.
+*/
+type State struct {
+	ID           string            `json:"id"`
+	Image        string            `json:"image"`
+	ImageName    string            `json:"imageName"`
+	Command      []string          `json:"command"`
+	Env          []string          `json:"env"`
+	WorkingDir   string            `json:"workingDir,omitempty"`
+	User         string            `json:"user,omitempty"`
+	StopSignal   string            `json:"stopSignal"`
+	Resources    cgroups.Resources `json:"resources"`
+	CgroupParent string            `json:"cgroupParent"`
+	Ulimits      []Ulimit          `json:"ulimits"`
+	OomScoreAdj  int               `json:"oomScoreAdj"`
+	Pid          int               `json:"pid"`
+	Status       string            `json:"status"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	FinishedAt   time.Time         `json:"finishedAt"`
+	StartedAt    time.Time         `json:"startedAt"`
+	ExitCode     int               `json:"exitCode"`
+	OOMKilled    bool              `json:"oomKilled"`
+	Usage        *Usage            `json:"usage,omitempty"`
+}
+
+/*
+	Usage is the resource usage of a container over its whole run, recorded
+	when it exits.
+*/
+type Usage struct {
+	WallTime   time.Duration `json:"wallTime"`
+	CpuUser    time.Duration `json:"cpuUser"`
+	CpuSystem  time.Duration `json:"cpuSystem"`
+	MemoryPeak int64         `json:"memoryPeak"`
+	PidsPeak   int64         `json:"pidsPeak"`
+	OomKills   int64         `json:"oomKills"`
+	NetRxBytes uint64        `json:"netRxBytes"`
+	NetTxBytes uint64        `json:"netTxBytes"`
+}
+
+type Accessor struct{}
+
+func GetAccessor() Accessor {
+	return Accessor{}
+}
+
+func (c Accessor) SaveState(state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(workdirs.GetContainerStatePath(state.ID), data, 0644)
+}
+
+func (c Accessor) LoadState(containerID string) (*State, error) {
+	data, err := ioutil.ReadFile(workdirs.GetContainerStatePath(containerID))
+	if err != nil {
+		return nil, err
+	}
+	/* Limits missing from state files written by older versions stay unset */
+	state := &State{Resources: cgroups.NewResources()}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (c Accessor) ListStates() ([]*State, error) {
+	entries, err := ioutil.ReadDir(workdirs.ContainersPath())
+	if err != nil {
+		return nil, err
+	}
+	var states []*State
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if state, err := c.LoadState(entry.Name()); err == nil {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+func (c Accessor) RemoveContainer(containerID string) error {
+	return os.RemoveAll(workdirs.GetContainerHome(containerID))
+}
+
+/* Returns the cgroups accessor for the parent group of the container */
+func (s *State) CGroups() cgroups.Accessor {
+	return cgroups.GetAccessor().WithParent(s.CgroupParent)
+}
+
+/*
+	A container only counts as running while its init process is still alive,
+	so a state file left behind by a crashed f-docker is reported as stopped.
+*/
+func (s *State) IsRunning() bool {
+	if s.Status != StatusRunning || s.Pid <= 0 {
+		return false
+	}
+	return unix.Kill(s.Pid, 0) == nil
+}
+
+/*
+	Mounts the overlay filesystem of a container at target. The same upperdir
+	and workdir are used for every mount, so a container must only be mounted
+	once at a time.
+*/
+func (c Accessor) MountOverlay(containerID string, imageShaHex string, target string) error {
+	srcLayers := image.GetAccessor().GetLayerPathsForImage(imageShaHex)
+	mntOptions := "lowerdir=" + strings.Join(srcLayers, ":") +
+		",upperdir=" + workdirs.GetContainerUpperDirPath(containerID) +
+		",workdir=" + workdirs.GetContainerWorkDirPath(containerID)
+	return unix.Mount("none", target, "overlay", 0, mntOptions)
+}
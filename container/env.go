@@ -0,0 +1,39 @@
+package container
+
+import (
+	"strings"
+)
+
+/* The PATH docker gives containers whose image does not set one */
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+/*
+	Combines the environment of an image with the variables given for a
+	container, which take precedence. The order of the image's variables is
+	kept, new ones are appended.
+*/
+func MergeEnv(env []string, overrides []string) []string {
+	merged := append([]string{}, env...)
+	for _, variable := range overrides {
+		name := strings.SplitN(variable, "=", 2)[0]
+		replaced := false
+		for n := range merged {
+			if strings.SplitN(merged[n], "=", 2)[0] == name {
+				merged[n], replaced = variable, true
+			}
+		}
+		if !replaced {
+			merged = append(merged, variable)
+		}
+	}
+	return merged
+}
+
+func LookupEnv(env []string, name string) (string, bool) {
+	for _, variable := range env {
+		if strings.HasPrefix(variable, name+"=") {
+			return variable[len(name)+1:], true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,30 @@
+package container
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+/* Docker stops containers with SIGTERM unless their image says otherwise */
+const DefaultStopSignal = "SIGTERM"
+
+/* Parses a signal given by name, with or without SIG, or by number */
+func ParseSignal(s string) (syscall.Signal, error) {
+	if num, err := strconv.Atoi(s); err == nil {
+		if num <= 0 || len(unix.SignalName(syscall.Signal(num))) == 0 {
+			return 0, fmt.Errorf("invalid signal %s", s)
+		}
+		return syscall.Signal(num), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("invalid signal %s", s)
+}
@@ -0,0 +1,178 @@
+package container
+
+import (
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ulimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"rttime":     unix.RLIMIT_RTTIME,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+/*
+	Ulimit is a resource limit of the container command, given as
+	<name>=<soft>[:<hard>]. Soft and Hard are -1 for "unlimited".
+*/
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+func (u Ulimit) String() string {
+	return u.Name + "=" + formatRlimit(u.Soft) + ":" + formatRlimit(u.Hard)
+}
+
+func formatRlimit(value int64) string {
+	if value < 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+func parseRlimit(value string) (int64, error) {
+	if value == "unlimited" || value == "-1" {
+		return -1, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid limit value: %s", value)
+	}
+	return n, nil
+}
+
+func ParseUlimit(value string) (Ulimit, error) {
+	nameAndLimits := strings.SplitN(value, "=", 2)
+	if len(nameAndLimits) != 2 {
+		return Ulimit{}, fmt.Errorf("invalid ulimit %s, expected <name>=<soft>[:<hard>]", value)
+	}
+	ulimit := Ulimit{Name: nameAndLimits[0]}
+	if _, ok := ulimitResources[ulimit.Name]; !ok {
+		return ulimit, fmt.Errorf("unknown ulimit %s", ulimit.Name)
+	}
+	limits := strings.SplitN(nameAndLimits[1], ":", 2)
+	var err error
+	if ulimit.Soft, err = parseRlimit(limits[0]); err != nil {
+		return ulimit, err
+	}
+	ulimit.Hard = ulimit.Soft
+	if len(limits) == 2 {
+		if ulimit.Hard, err = parseRlimit(limits[1]); err != nil {
+			return ulimit, err
+		}
+	}
+	/* The kernel caps open files at fs.nr_open, it refuses an unlimited nofile */
+	if ulimit.Name == "nofile" && (ulimit.Soft < 0 || ulimit.Hard < 0) {
+		return ulimit, fmt.Errorf("ulimit nofile can not be unlimited, pass a number of files")
+	}
+	if ulimit.Hard >= 0 && (ulimit.Soft < 0 || ulimit.Soft > ulimit.Hard) {
+		return ulimit, fmt.Errorf("soft limit of ulimit %s must not exceed the hard limit", value)
+	}
+	return ulimit, nil
+}
+
+func (u Ulimit) rlimit() *unix.Rlimit {
+	toRlim := func(value int64) uint64 {
+		if value < 0 {
+			return math.MaxUint64
+		}
+		return uint64(value)
+	}
+	return &unix.Rlimit{Cur: toRlim(u.Soft), Max: toRlim(u.Hard)}
+}
+
+/* Sets the limit for the calling process, the commands it starts inherit it */
+func (u Ulimit) Apply() error {
+	return unix.Setrlimit(ulimitResources[u.Name], u.rlimit())
+}
+
+/*
+	Raising a hard limit takes CAP_SYS_RESOURCE in the initial user
+	namespace, which child-mode lacks. run calls this on itself before it
+	starts child-mode, so that child-mode inherits hard limits that are high
+	enough. Soft limits and lower hard limits are left to Apply.
+*/
+func (u Ulimit) RaiseHardLimit() error {
+	resource := ulimitResources[u.Name]
+	var current unix.Rlimit
+	if err := unix.Getrlimit(resource, &current); err != nil {
+		return err
+	}
+	wanted := u.rlimit().Max
+	if wanted <= current.Max {
+		return nil
+	}
+	current.Max = wanted
+	return unix.Setrlimit(resource, &current)
+}
+
+/*
+	Combines the global default ulimits with the ones given for a container,
+	which take precedence. The result is sorted by name.
+*/
+func MergeUlimits(defaults []Ulimit, ulimits []Ulimit) []Ulimit {
+	byName := make(map[string]Ulimit)
+	for _, ulimit := range defaults {
+		byName[ulimit.Name] = ulimit
+	}
+	for _, ulimit := range ulimits {
+		byName[ulimit.Name] = ulimit
+	}
+	var merged []Ulimit
+	for _, ulimit := range byName {
+		merged = append(merged, ulimit)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Name < merged[j].Name
+	})
+	return merged
+}
+
+type ulimitsValue struct {
+	ulimits *[]Ulimit
+}
+
+func (v *ulimitsValue) Set(value string) error {
+	ulimit, err := ParseUlimit(value)
+	if err != nil {
+		return err
+	}
+	*v.ulimits = append(*v.ulimits, ulimit)
+	return nil
+}
+
+func (v *ulimitsValue) String() string {
+	var values []string
+	for _, ulimit := range *v.ulimits {
+		values = append(values, ulimit.String())
+	}
+	return "[" + strings.Join(values, ",") + "]"
+}
+
+func (v *ulimitsValue) Type() string {
+	return "list"
+}
+
+func AddUlimitFlag(fs *flag.FlagSet, ulimits *[]Ulimit) {
+	fs.Var(&ulimitsValue{ulimits: ulimits}, "ulimit", "Ulimit of the container command (nofile=1024:4096)")
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fdocker/workdirs"
+	"os"
+	"time"
+)
+
+const (
+	TypeStart   = "start"
+	TypeDie     = "die"
+	TypeOOM     = "oom"
+	TypeDestroy = "destroy"
+)
+
+/*
+	Event records something that happened to a container. Events are appended
+	as one JSON object per line to the events log, which keeps them around
+	after the container itself has been removed.
+*/
+type Event struct {
+	Time        time.Time         `json:"time"`
+	Type        string            `json:"type"`
+	ContainerID string            `json:"containerId"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+type Accessor struct{}
+
+func GetAccessor() Accessor {
+	return Accessor{}
+}
+
+func (e Accessor) Emit(eventType string, containerID string, attributes map[string]string) error {
+	data, err := json.Marshal(Event{
+		Time:        time.Now(),
+		Type:        eventType,
+		ContainerID: containerID,
+		Attributes:  attributes,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(workdirs.EventsPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+/*
+	Returns the logged events, oldest first. Lines that can not be parsed,
+	e.g. one cut short by a crash, are skipped.
+*/
+func (e Accessor) ListEvents() ([]Event, error) {
+	f, err := os.Open(workdirs.EventsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events, scanner.Err()
+}
@@ -5,8 +5,6 @@ import (
 	"fdocker/utils"
 	"fdocker/workdirs"
 	"fmt"
-	"github.com/google/go-containerregistry/pkg/crane"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"io/ioutil"
 	"log"
 	"os"
@@ -20,30 +18,47 @@ type Manifest struct {
 	Layers   []string
 }
 
+/*
+	ConfigDetails is the execution part of an OCI image config, the
+	defaults for containers created from the image.
+*/
 type ConfigDetails struct {
-	Env []string `json:"Env"`
-	Cmd []string `json:"Cmd"`
+	User         string              `json:"User"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	Env          []string            `json:"Env"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	Cmd          []string            `json:"Cmd"`
+	Volumes      map[string]struct{} `json:"Volumes"`
+	WorkingDir   string              `json:"WorkingDir"`
+	Labels       map[string]string   `json:"Labels"`
+	StopSignal   string              `json:"StopSignal"`
+}
+
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
 }
 
 type Config struct {
-	Config ConfigDetails `json:"config"`
+	Architecture string        `json:"architecture"`
+	OS           string        `json:"os"`
+	Config       ConfigDetails `json:"config"`
+	RootFS       RootFS        `json:"rootfs"`
 }
 
 /*
 This is the format of our imageDB file where we store the
-list of images we have on the system.
+list of images we have on the system. Images are keyed by their
+normalized repository, entries are tags or the manifest digests
+images were pulled by.
 {
-	"ubuntu" : {
+	"docker.io/library/ubuntu" : {
 					"18.04": "[image-hash]",
-					"18.10": "[image-hash]",
-					"19.04": "[image-hash]",
-					"19.10": "[image-hash]",
+					"20.04": "[image-hash]",
+					"sha256:[manifest-digest]": "[image-hash]",
 				},
-	"centos" : {
-					"6.0": "[image-hash]",
-					"6.1": "[image-hash]",
-					"6.2": "[image-hash]",
-					"7.0": "[image-hash]",
+	"localhost:5000/team/app" : {
+					"1.2": "[image-hash]",
 				}
 }
 */
@@ -51,23 +66,26 @@ list of images we have on the system.
 type imageEntries map[string]string
 type imagesDB map[string]imageEntries
 
-type Accessor struct{}
+/*
+	Insecure makes pulls and pushes talk plain HTTP to registries that are
+	not on localhost or a private network, which go-containerregistry
+	already reaches that way.
+*/
+type Accessor struct {
+	Insecure bool
+}
 
 func GetAccessor() Accessor {
 	return Accessor{}
 }
 
+/*
+	Returns the familiar name and a tag of an image, or the digest it was
+	pulled by when it has no tag.
+*/
 func (i Accessor) GetImageAndTagByHash(imageShaHash string) (string, string) {
-	idb := imagesDB{}
-	i.parseImagesMetadata(&idb)
-	for image, versions := range idb {
-		for version, hash := range versions {
-			if hash == imageShaHash {
-				return image, version
-			}
-		}
-	}
-	return "", ""
+	imgName, imgTag := i.imageExistsByHash(imageShaHash)
+	return FamiliarName(imgName), imgTag
 }
 
 func (i Accessor) GetBasePathForImage(imageShaHex string) string {
@@ -82,87 +100,148 @@ func (i Accessor) GetConfigPathForImage(imageShaHex string) string {
 	return path.Join(i.GetBasePathForImage(imageShaHex), imageShaHex+".json")
 }
 
-func (i Accessor) deleteTempImageFiles(imageShaHash string) {
-	tmpPath := path.Join(workdirs.TempPath(), imageShaHash)
-	utils.MustWithMsg(os.RemoveAll(tmpPath),
-		"Unable to remove temporary image files")
+/*
+	Returns the extracted layer directories of an image ordered from the
+	topmost layer to the base layer, which is the order overlayfs expects
+	for its lowerdir option. Images pulled before the shared layer store
+	existed still carry their layers below their own directory.
+*/
+func (i Accessor) GetLayerPathsForImage(imageShaHex string) []string {
+	var layerPaths []string
+	chainIDs := i.GetLayerChainIDsForImage(imageShaHex)
+	if len(chainIDs) == 0 || !i.layersExist(chainIDs) {
+		mani := i.ParseManifest(i.GetManifestPathForImage(imageShaHex))
+		imageBasePath := i.GetBasePathForImage(imageShaHex)
+		for _, layer := range mani.Layers {
+			layerPaths = append([]string{path.Join(imageBasePath, layer[:12], "fs")}, layerPaths...)
+		}
+		return layerPaths
+	}
+	for _, chainID := range chainIDs {
+		layerPaths = append([]string{i.GetLayerPath(chainID)}, layerPaths...)
+	}
+	return layerPaths
 }
 
 func (i Accessor) imageExistsByHash(imageShaHex string) (string, string) {
 	idb := imagesDB{}
 	i.parseImagesMetadata(&idb)
-	for imgName, avlImages := range idb {
-		for imgTag, imgHash := range avlImages {
-			if imgHash == imageShaHex {
-				return imgName, imgTag
+	imgName, imgTag := "", ""
+	for repository, avlImages := range idb {
+		for entry, imgHash := range avlImages {
+			if imgHash != imageShaHex {
+				continue
+			}
+			/* Prefer tags over digests */
+			if len(imgName) == 0 || isDigest(imgTag) && !isDigest(entry) {
+				imgName, imgTag = repository, entry
 			}
 		}
 	}
-	return "", ""
+	return imgName, imgTag
 }
 
-func (i Accessor) imageExistByTag(imgName string, tagName string) (bool, string) {
+/* A digest pinned reference only matches the image pulled by that digest */
+func (i Accessor) imageExistsByReference(ref Reference) (bool, string) {
 	idb := imagesDB{}
 	i.parseImagesMetadata(&idb)
-	for k, v := range idb {
-		if k == imgName {
-			for k, v := range v {
-				if k == tagName {
-					return true, v
-				}
-			}
-		}
+	entry := ref.Tag
+	if len(ref.Digest) > 0 {
+		entry = ref.Digest
 	}
-	return false, ""
+	imageShaHex, ok := idb[ref.Repository()][entry]
+	return ok, imageShaHex
 }
 
-func (i Accessor) downloadImage(img v1.Image, imageShaHex string, src string) {
-	imagePath := path.Join(workdirs.TempPath(), imageShaHex)
-	utils.Must(os.Mkdir(imagePath, 0755))
-	tarPath := path.Join(imagePath, "package.tar")
-	/* Save the image as a tar file */
-	if err := crane.SaveLegacy(img, src, tarPath); err != nil {
-		log.Fatalf("saving tarball %s: %v", tarPath, err)
+/* Looks up an installed image by its ID or by a reference */
+func (i Accessor) FindImage(src string) (string, bool) {
+	if imgName, _ := i.imageExistsByHash(src); len(imgName) > 0 {
+		return src, true
 	}
-	log.Printf("Successfully downloaded %s\n", src)
-}
-
-func (i Accessor) unTarFile(imageShaHex string) {
-	pathDir := path.Join(workdirs.TempPath(), imageShaHex)
-	tarPath := path.Join(pathDir, "package.tar")
-	if err := utils.UnTar(tarPath, pathDir); err != nil {
-		log.Fatalf("Error untaring file: %v\n", err)
+	ref, err := ParseReference(src)
+	if err != nil {
+		return "", false
 	}
+	exists, imageShaHex := i.imageExistsByReference(ref)
+	return imageShaHex, exists
 }
 
-func (i Accessor) processLayerTarballs(imageShaHex string, fullImageHex string) {
-	tmpPathDir := path.Join(workdirs.TempPath(), imageShaHex)
-	pathManifest := path.Join(tmpPathDir, "manifest.json")
-	pathConfig := path.Join(tmpPathDir, fullImageHex+".json")
+func isDigest(entry string) bool {
+	return strings.HasPrefix(entry, "sha256:")
+}
 
-	mani := i.ParseManifest(pathManifest)
-	imagesDir := path.Join(workdirs.ImagesPath(), imageShaHex)
-	_ = os.Mkdir(imagesDir, 0755)
+/*
+	Installs an image of an extracted docker archive in dir, mani is its
+	entry in the manifest.json of the archive. The image ID is derived from
+	the config like for pulled images. digests are the ones of the layer
+	files, if the archive records them. Returns the image ID.
+*/
+func (i Accessor) processLayerTarballs(dir string, mani *Manifest, digests []string) string {
+	pathConfig, err := utils.ResolvePathInRoot(dir, mani.Config)
+	if err != nil {
+		log.Fatalf("Invalid config path %s: %v\n", mani.Config, err)
+	}
+	fullImageHex, err := fileSha256(pathConfig)
+	if err != nil {
+		log.Fatalf("Could not read image config file: %v\n", err)
+	}
+	imageShaHex := fullImageHex[:12]
+	if _, err := os.Stat(i.GetBasePathForImage(imageShaHex)); err == nil {
+		log.Printf("Image %s already exists\n", imageShaHex)
+		return imageShaHex
+	}
+	imgConfig := i.parseConfigFile(pathConfig)
+	if len(mani.Layers) != len(imgConfig.RootFS.DiffIDs) {
+		log.Fatalf("Image has %d layers but %d diff IDs\n", len(mani.Layers), len(imgConfig.RootFS.DiffIDs))
+	}
 	/* untar the layer files. These become the basis of our container root fs */
-	for _, layer := range mani.Layers {
-		imageLayerDir := path.Join(imagesDir, layer[:12], "fs")
-		log.Printf("Uncompressing layer to: %s \n", imageLayerDir)
-		_ = os.MkdirAll(imageLayerDir, 0755)
-		srcLayer := path.Join(tmpPathDir, layer)
-		if err := utils.UnTar(srcLayer, imageLayerDir); err != nil {
-			log.Fatalf("Unable to untar layer file: %s: %v\n", srcLayer, err)
+	chainIDs := ChainIDs(imgConfig.RootFS.DiffIDs)
+	i.addLayerReferences(imageShaHex, chainIDs)
+	for n, layer := range mani.Layers {
+		if i.layerExists(chainIDs[n]) {
+			log.Printf("Layer %s already exists\n", chainIDs[n])
+			continue
+		}
+		log.Printf("Uncompressing layer %s\n", chainIDs[n])
+		srcLayer, err := utils.ResolvePathInRoot(dir, layer)
+		if err != nil {
+			log.Fatalf("Invalid layer path %s: %v\n", layer, err)
+		}
+		err = i.installLayer(chainIDs[n], func(dir string) error {
+			f, err := os.Open(srcLayer)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			digest := ""
+			if digests != nil {
+				digest = digests[n]
+			}
+			return extractLayer(f, dir, digest, imgConfig.RootFS.DiffIDs[n])
+		})
+		if err != nil {
+			i.abandonImage(imageShaHex, chainIDs)
+			log.Fatalf("Unable to extract layer %s: %v\n", imgConfig.RootFS.DiffIDs[n], err)
 		}
 	}
-	/* Copy the Manifest file for reference later */
-	err := utils.CopyFile(pathManifest, i.GetManifestPathForImage(imageShaHex))
+	/* Keep the config and a manifest for reference later */
+	err = i.publishImage(imageShaHex, func(imageDir string) error {
+		if err := utils.CopyFile(pathConfig, path.Join(imageDir, imageShaHex+".json")); err != nil {
+			return err
+		}
+		return writeManifest(imageDir, fullImageHex+".json", mani.RepoTags, imgConfig.RootFS.DiffIDs)
+	})
 	if err != nil {
-		log.Printf("[warning]")
+		log.Fatalf("Unable to save image %s: %v\n", imageShaHex, err)
 	}
-	utils.CopyFile(pathConfig, i.GetConfigPathForImage(imageShaHex))
+	return imageShaHex
 }
 
 func (i Accessor) ParseContainerConfig(imageShaHex string) Config {
-	imagesConfigPath := i.GetConfigPathForImage(imageShaHex)
+	return i.parseConfigFile(i.GetConfigPathForImage(imageShaHex))
+}
+
+func (i Accessor) parseConfigFile(imagesConfigPath string) Config {
 	data, err := ioutil.ReadFile(imagesConfigPath)
 	if err != nil {
 		log.Fatalf("Could not read image config file")
@@ -187,6 +266,22 @@ func (i Accessor) parseImagesMetadata(idb *imagesDB) {
 	if err := json.Unmarshal(data, idb); err != nil {
 		log.Fatalf("Unable to parse images DB: %v\n", err)
 	}
+	/* Older versions stored images by the name that was passed to run */
+	for image, entries := range *idb {
+		ref, err := ParseReference(image)
+		if err != nil || ref.Repository() == image {
+			continue
+		}
+		normalized := (*idb)[ref.Repository()]
+		if normalized == nil {
+			normalized = imageEntries{}
+		}
+		for entry, hash := range entries {
+			normalized[entry] = hash
+		}
+		(*idb)[ref.Repository()] = normalized
+		delete(*idb, image)
+	}
 }
 
 func (i Accessor) marshalImageMetadata(idb imagesDB) {
@@ -200,42 +295,43 @@ func (i Accessor) marshalImageMetadata(idb imagesDB) {
 	}
 }
 
-func (i Accessor) storeImageMetadata(image string, tag string, imageShaHex string) {
+/* Records the tag and the digest of ref, either may be empty */
+func (i Accessor) storeImageMetadata(ref Reference, imageShaHex string) {
 	idb := imagesDB{}
 	ientry := imageEntries{}
 	i.parseImagesMetadata(&idb)
-	if idb[image] != nil {
-		ientry = idb[image]
+	if idb[ref.Repository()] != nil {
+		ientry = idb[ref.Repository()]
 	}
-	ientry[tag] = imageShaHex
-	idb[image] = ientry
+	for _, entry := range []string{ref.Tag, ref.Digest} {
+		if len(entry) > 0 {
+			ientry[entry] = imageShaHex
+		}
+	}
+	idb[ref.Repository()] = ientry
 
 	i.marshalImageMetadata(idb)
 }
 
+/* Drops every tag and digest of every repository that refers to the image */
 func (i Accessor) removeImageMetadata(imageShaHex string) {
 	idb := imagesDB{}
-	ientries := imageEntries{}
 	i.parseImagesMetadata(&idb)
-	imgName, _ := i.imageExistsByHash(imageShaHex)
-	if len(imgName) == 0 {
-		log.Fatalf("Could not get image details")
-	}
-	ientries = idb[imgName]
-	for tag, hash := range ientries {
-		if hash == imageShaHex {
-			delete(ientries, tag)
+	for imgName, ientries := range idb {
+		for entry, hash := range ientries {
+			if hash == imageShaHex {
+				delete(ientries, entry)
+			}
+		}
+		if len(ientries) == 0 {
+			delete(idb, imgName)
 		}
-	}
-	if len(ientries) == 0 {
-		delete(idb, imgName)
-	} else {
-		idb[imgName] = ientries
 	}
 	i.marshalImageMetadata(idb)
 }
 
 func (i Accessor) DeleteImageByHash(imageShaHex string) {
+	i.releaseLayers(imageShaHex, i.GetLayerChainIDsForImage(imageShaHex))
 	utils.MustWithMsg(os.RemoveAll(path.Join(workdirs.ImagesPath(), imageShaHex)),
 		"Unable to remove image directory")
 	i.removeImageMetadata(imageShaHex)
@@ -246,55 +342,20 @@ func (i Accessor) PrintAvailableImages() {
 	i.parseImagesMetadata(&idb)
 	fmt.Printf("IMAGE\t             TAG\t   ID\n")
 	for image, details := range idb {
-		fmt.Println(image)
+		fmt.Println(FamiliarName(image))
 		for tag, hash := range details {
 			fmt.Printf("\t%16s %s\n", tag, hash)
 		}
 	}
 }
 
-func (i Accessor) GetImageNameAndTag(src string) (string, string) {
-	s := strings.Split(src, ":")
-	var img, tag string
-	if len(s) > 1 {
-		img, tag = s[0], s[1]
-	} else {
-		img = s[0]
-		tag = "latest"
-	}
-	return img, tag
-}
-
 func (i Accessor) DownloadImageIfRequired(src string) string {
-	imgName, tagName := i.GetImageNameAndTag(src)
-	if downloadRequired, imageShaHex := i.imageExistByTag(imgName, tagName); !downloadRequired {
-		/* Setup the image we want to pull */
-		log.Printf("Downloading metadata for %s:%s, please wait...", imgName, tagName)
-		img, err := crane.Pull(strings.Join([]string{imgName, tagName}, ":"))
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		manifest, _ := img.Manifest()
-		imageShaHex = manifest.Config.Digest.Hex[:12]
-		log.Printf("imageHash: %v\n", imageShaHex)
-		log.Println("Checking if image exists under another name...")
-		/* Identify cases where ubuntu:latest could be the same as ubuntu:20.04*/
-		altImgName, altImgTag := i.imageExistsByHash(imageShaHex)
-		if len(altImgName) > 0 && len(altImgTag) > 0 {
-			log.Printf("The image you requested %s:%s is the same as %s:%s\n",
-				imgName, tagName, altImgName, altImgTag)
-			i.storeImageMetadata(imgName, tagName, imageShaHex)
-			return imageShaHex
-		} else {
-			log.Println("Image doesn't exist. Downloading...")
-			i.downloadImage(img, imageShaHex, src)
-			i.unTarFile(imageShaHex)
-			i.processLayerTarballs(imageShaHex, manifest.Config.Digest.Hex)
-			i.storeImageMetadata(imgName, tagName, imageShaHex)
-			i.deleteTempImageFiles(imageShaHex)
-			return imageShaHex
-		}
+	ref, err := ParseReference(src)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if downloadRequired, imageShaHex := i.imageExistsByReference(ref); !downloadRequired {
+		return i.PullImage(ref)
 	} else {
 		log.Println("Image already exists. Not downloading.")
 		return imageShaHex
@@ -302,12 +363,21 @@ func (i Accessor) DownloadImageIfRequired(src string) string {
 }
 
 func (i Accessor) ParseManifest(manifestPath string) *Manifest {
+	m := i.ParseManifests(manifestPath)
+	if len(m) > 1 {
+		log.Fatalf("ParseManifest failed, manifest count = %d", len(m))
+	}
+	return m[0]
+}
+
+/* Docker archives list one entry per image in their manifest.json */
+func (i Accessor) ParseManifests(manifestPath string) []*Manifest {
 	m := make([]*Manifest, 0)
 	data, err := ioutil.ReadFile(manifestPath)
 	utils.Must(err)
 	utils.Must(json.Unmarshal(data, &m))
-	if len(m) == 0 || len(m) > 1 {
+	if len(m) == 0 {
 		log.Fatalf("ParseManifest failed, manifest count = %d", len(m))
 	}
-	return m[0]
+	return m
 }
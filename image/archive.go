@@ -0,0 +1,262 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fdocker/utils"
+	"fdocker/workdirs"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+)
+
+const (
+	DockerArchiveFormat = "docker"
+	OCIArchiveFormat    = "oci"
+)
+
+/*
+	Writes the images srcs refer to to w as a tar archive, either in the
+	format of docker save or as an OCI image layout. An image passed by tag
+	is saved with that tag, one passed by its ID with all of its tags.
+*/
+func (i Accessor) SaveImages(w io.Writer, srcs []string, format string) {
+	imageShaHexes, repoTags := i.resolveImages(srcs)
+	tmpPath, err := ioutil.TempDir(workdirs.TempPath(), "save-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	tarWriter := tar.NewWriter(w)
+	if format == OCIArchiveFormat {
+		err = i.writeOCILayout(tarWriter, tmpPath, imageShaHexes, repoTags)
+	} else {
+		err = i.writeDockerArchive(tarWriter, tmpPath, imageShaHexes, repoTags)
+	}
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err != nil {
+		log.Fatalf("Unable to write archive: %v\n", err)
+	}
+}
+
+/* Returns the IDs of the images srcs refer to and the tags to save them with */
+func (i Accessor) resolveImages(srcs []string) ([]string, map[string][]string) {
+	var imageShaHexes []string
+	repoTags := make(map[string][]string)
+	for _, src := range srcs {
+		imageShaHex, ok := i.FindImage(src)
+		if !ok {
+			log.Fatalf("No such image: %s\n", src)
+		}
+		if _, seen := repoTags[imageShaHex]; !seen {
+			imageShaHexes = append(imageShaHexes, imageShaHex)
+			repoTags[imageShaHex] = []string{}
+		}
+		var tags []string
+		if imageShaHex == src {
+			tags = i.imageTags(imageShaHex)
+		} else if ref, _ := ParseReference(src); len(ref.Digest) == 0 {
+			tags = []string{FamiliarName(ref.Repository()) + ":" + ref.Tag}
+		}
+		for _, tag := range tags {
+			if !containsString(repoTags[imageShaHex], tag) {
+				repoTags[imageShaHex] = append(repoTags[imageShaHex], tag)
+			}
+		}
+	}
+	return imageShaHexes, repoTags
+}
+
+/*
+	Writes a manifest.json with an entry per image, the configs and an
+	uncompressed layer.tar per layer, like docker save.
+*/
+func (i Accessor) writeDockerArchive(tarWriter *tar.Writer, tmpPath string, imageShaHexes []string, repoTags map[string][]string) error {
+	var manifests []Manifest
+	written := make(map[string]bool)
+	for _, imageShaHex := range imageShaHexes {
+		log.Printf("Saving image %s\n", imageShaHex)
+		img := i.assembleImage(imageShaHex, tmpPath)
+		configName, err := img.ConfigName()
+		if err != nil {
+			log.Fatalf("Unable to get image config digest: %v\n", err)
+		}
+		rawConfig, err := img.RawConfigFile()
+		if err != nil {
+			log.Fatalf("Unable to get image config: %v\n", err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			log.Fatalf("Unable to get image layers: %v\n", err)
+		}
+		mani := Manifest{Config: configName.Hex + ".json", RepoTags: repoTags[imageShaHex]}
+		err = writeArchiveEntry(tarWriter, mani.Config, bytes.NewReader(rawConfig), int64(len(rawConfig)))
+		if err != nil {
+			return err
+		}
+		for _, layer := range layers {
+			diffID, err := layer.DiffID()
+			if err != nil {
+				log.Fatalf("Unable to archive layer: %v\n", err)
+			}
+			name := path.Join(diffID.Hex, "layer.tar")
+			mani.Layers = append(mani.Layers, name)
+			/* Images share their base layers */
+			if written[name] {
+				continue
+			}
+			written[name] = true
+			if err := writeArchiveLayer(tarWriter, name, layer, tmpPath); err != nil {
+				return err
+			}
+		}
+		manifests = append(manifests, mani)
+	}
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+	return writeArchiveEntry(tarWriter, "manifest.json", bytes.NewReader(data), int64(len(data)))
+}
+
+/* Returns the tags of an image as repository:tag, sorted */
+func (i Accessor) imageTags(imageShaHex string) []string {
+	idb := imagesDB{}
+	i.parseImagesMetadata(&idb)
+	var tags []string
+	for repository, avlImages := range idb {
+		for entry, imgHash := range avlImages {
+			if imgHash == imageShaHex && !isDigest(entry) {
+				tags = append(tags, FamiliarName(repository)+":"+entry)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func writeArchiveEntry(tarWriter *tar.Writer, name string, r io.Reader, size int64) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(tarWriter, r)
+	return err
+}
+
+func writeArchiveFile(tarWriter *tar.Writer, name string, srcPath string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return writeArchiveEntry(tarWriter, name, f, info.Size())
+}
+
+/* Stages the uncompressed layer below tmpPath, tar entries need their size up front */
+func writeArchiveLayer(tarWriter *tar.Writer, name string, layer v1.Layer, tmpPath string) error {
+	uncompressed, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer uncompressed.Close()
+	f, err := ioutil.TempFile(tmpPath, "layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, uncompressed); err != nil {
+		return err
+	}
+	return writeArchiveFile(tarWriter, name, f.Name())
+}
+
+/*
+	Installs every image of a docker archive read from r, which may be
+	gzipped, and tags them with the RepoTags of their manifest entries.
+*/
+func (i Accessor) LoadImages(r io.Reader) {
+	tmpPath, err := ioutil.TempDir(workdirs.TempPath(), "load-")
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	if err := extractArchive(r, tmpPath); err != nil {
+		log.Fatalf("Unable to read archive: %v\n", err)
+	}
+
+	manifests := i.ParseManifests(path.Join(tmpPath, "manifest.json"))
+	refs := make([][]Reference, len(manifests))
+	for n, mani := range manifests {
+		/* Check all tags before anything is installed */
+		refs[n] = parseRepoTags(mani)
+	}
+	for n, mani := range manifests {
+		i.loadImage(tmpPath, mani, nil, refs[n])
+	}
+}
+
+func extractArchive(r io.Reader, dir string) error {
+	reader := bufio.NewReader(r)
+	var archive io.Reader = reader
+	if magic, _ := reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		archive = gzipReader
+	}
+	return utils.ExtractTar(archive, inLayer(dir))
+}
+
+/* Parses the RepoTags of mani and normalizes them to repository:tag */
+func parseRepoTags(mani *Manifest) []Reference {
+	var refs []Reference
+	for t, repoTag := range mani.RepoTags {
+		ref, err := ParseReference(repoTag)
+		if err != nil {
+			log.Fatalf("Invalid tag %s in archive: %v\n", repoTag, err)
+		}
+		if len(ref.Digest) > 0 {
+			log.Fatalf("Invalid tag %s in archive: digests can not be tags\n", repoTag)
+		}
+		refs = append(refs, ref)
+		mani.RepoTags[t] = FamiliarName(ref.Repository()) + ":" + ref.Tag
+	}
+	return refs
+}
+
+/* Installs an image of an extracted archive and tags it with refs */
+func (i Accessor) loadImage(dir string, mani *Manifest, digests []string, refs []Reference) {
+	imageShaHex := i.processLayerTarballs(dir, mani, digests)
+	for _, ref := range refs {
+		i.storeImageMetadata(ref, imageShaHex)
+	}
+	if len(mani.RepoTags) == 0 {
+		fmt.Printf("Loaded image ID: %s\n", imageShaHex)
+	}
+	for _, repoTag := range mani.RepoTags {
+		fmt.Printf("Loaded image: %s\n", repoTag)
+	}
+}
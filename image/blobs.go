@@ -0,0 +1,88 @@
+package image
+
+import (
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"io"
+	"net/http"
+)
+
+/*
+	Fetches a blob from the registry starting at offset, so an interrupted
+	download can be continued. Registries that ignore the Range header send
+	the whole blob, the returned offset is where the body actually starts.
+*/
+func (i Accessor) openBlob(repository string, digest v1.Hash, offset int64) (io.ReadCloser, int64, error) {
+	client, req, err := i.blobRequest(http.MethodGet, repository, digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		offset = 0
+	}
+	return resp.Body, offset, nil
+}
+
+func (i Accessor) blobExists(repository string, digest v1.Hash) (bool, error) {
+	client, req, err := i.blobRequest(http.MethodHead, repository, digest)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusNotFound); err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+/* Builds a request for a blob and a client that authenticates it with the registry */
+func (i Accessor) blobRequest(method string, repository string, digest v1.Hash) (*http.Client, *http.Request, error) {
+	repo, err := name.NewRepository(repository, i.nameOptions()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, err := authn.DefaultKeychain.Resolve(repo.Registry)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr, err := transport.New(repo.Registry, auth, http.DefaultTransport, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, nil, err
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), digest)
+	req, err := http.NewRequest(method, url, nil)
+	return &http.Client{Transport: tr}, req, err
+}
+
+func (i Accessor) nameOptions() []name.Option {
+	if i.Insecure {
+		return []name.Option{name.Insecure}
+	}
+	return nil
+}
+
+func (i Accessor) craneOptions() []crane.Option {
+	if i.Insecure {
+		return []crane.Option{crane.Insecure}
+	}
+	return nil
+}
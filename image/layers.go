@@ -0,0 +1,238 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fdocker/workdirs"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+	Layers are extracted once into a store shared by all images and are
+	identified by their chain ID, which covers the layer and everything
+	below it:
+		ChainID(L0) = DiffID(L0)
+		ChainID(Ln) = sha256(ChainID(Ln-1) + " " + DiffID(Ln))
+	layers/refs.json records which images use a layer, a layer is deleted
+	together with the last image referencing it.
+*/
+func ChainIDs(diffIDs []string) []string {
+	chainIDs := make([]string, 0, len(diffIDs))
+	for n, diffID := range diffIDs {
+		if n == 0 {
+			chainIDs = append(chainIDs, diffID)
+			continue
+		}
+		sum := sha256.Sum256([]byte(chainIDs[n-1] + " " + diffID))
+		chainIDs = append(chainIDs, "sha256:"+hex.EncodeToString(sum[:]))
+	}
+	return chainIDs
+}
+
+func (i Accessor) GetLayerPath(chainID string) string {
+	return path.Join(workdirs.LayersPath(), strings.TrimPrefix(chainID, "sha256:"), "fs")
+}
+
+/* The layer as it was pulled or loaded, kept to push and save it unchanged */
+func layerBlobPath(layerDir string) string {
+	return path.Join(layerDir, "blob")
+}
+
+func (i Accessor) layerExists(chainID string) bool {
+	_, err := os.Stat(i.GetLayerPath(chainID))
+	return err == nil
+}
+
+func (i Accessor) layersExist(chainIDs []string) bool {
+	for _, chainID := range chainIDs {
+		if !i.layerExists(chainID) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Returns the chain IDs of the layers of an image from the base layer up */
+func (i Accessor) GetLayerChainIDsForImage(imageShaHex string) []string {
+	return ChainIDs(i.ParseContainerConfig(imageShaHex).RootFS.DiffIDs)
+}
+
+/*
+	Extracts a layer into the store unless it is there already. extract
+	fills the fs directory and the blob of a staging directory that is only
+	renamed into the store, together with the checksums of its files, once
+	it returned without error, so an interrupted pull never leaves a partial
+	layer behind. The staging directory is locked meanwhile, concurrent
+	pulls of the same layer wait for each other instead of extracting it
+	twice.
+*/
+func (i Accessor) installLayer(chainID string, extract func(dir string) error) error {
+	hex := strings.TrimPrefix(chainID, "sha256:")
+	stagingPath := path.Join(workdirs.TempPath(), "layers", hex)
+	unlock, err := lockPath(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if i.layerExists(chainID) {
+		return nil
+	}
+	/* Whatever is there was left behind by an interrupted pull */
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(stagingPath, "fs"), 0755); err != nil {
+		return err
+	}
+	if err := extract(stagingPath); err != nil {
+		os.RemoveAll(stagingPath)
+		return err
+	}
+	if err := writeChecksums(stagingPath); err != nil {
+		os.RemoveAll(stagingPath)
+		return err
+	}
+	if err := os.Rename(stagingPath, path.Dir(i.GetLayerPath(chainID))); err != nil {
+		return err
+	}
+	/* Anyone still waiting for the lock finds the layer installed */
+	return os.Remove(stagingPath + ".lock")
+}
+
+/*
+	Takes an exclusive lock on <p>.lock, creating the parent directory if
+	needed. The returned function releases it. Holders may remove the lock
+	file once they are done, a lock taken on a removed file is retried on
+	the current one.
+*/
+func lockPath(p string) (func(), error) {
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := os.OpenFile(p+".lock", os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+		var locked, current unix.Stat_t
+		if err := unix.Fstat(int(f.Fd()), &locked); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := unix.Stat(p+".lock", &current); err == nil && current.Ino == locked.Ino && current.Dev == locked.Dev {
+			return func() { f.Close() }, nil
+		}
+		f.Close()
+	}
+}
+
+/*
+	Runs fn with the images referencing each layer and saves them
+	afterwards, with the refs file locked meanwhile.
+*/
+func updateLayerRefs(fn func(refs map[string][]string) error) error {
+	f, err := os.OpenFile(path.Join(workdirs.LayersPath(), "refs.json"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	refs := make(map[string][]string)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &refs); err != nil {
+			return err
+		}
+	}
+
+	fnErr := fn(refs)
+
+	if data, err = json.Marshal(refs); err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (i Accessor) addLayerReferences(imageShaHex string, chainIDs []string) {
+	err := updateLayerRefs(func(refs map[string][]string) error {
+		for _, chainID := range chainIDs {
+			if !containsString(refs[chainID], imageShaHex) {
+				refs[chainID] = append(refs[chainID], imageShaHex)
+				sort.Strings(refs[chainID])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Unable to record layer references: %v\n", err)
+	}
+}
+
+/* Drops the references of an image and deletes the layers no other image uses */
+func (i Accessor) releaseLayers(imageShaHex string, chainIDs []string) {
+	err := updateLayerRefs(func(refs map[string][]string) error {
+		for _, chainID := range chainIDs {
+			var remaining []string
+			for _, ref := range refs[chainID] {
+				if ref != imageShaHex {
+					remaining = append(remaining, ref)
+				}
+			}
+			if len(remaining) > 0 {
+				refs[chainID] = remaining
+				continue
+			}
+			delete(refs, chainID)
+			if err := os.RemoveAll(path.Dir(i.GetLayerPath(chainID))); err != nil {
+				return err
+			}
+			log.Printf("Deleted layer %s\n", chainID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Unable to release layers: %v\n", err)
+	}
+}
+
+/*
+	Drops the layer references of an image whose install failed, which
+	deletes the layers that were installed for it alone. The layers stay if
+	a concurrent install of the same image published it meanwhile.
+*/
+func (i Accessor) abandonImage(imageShaHex string, chainIDs []string) {
+	if _, err := os.Stat(i.GetBasePathForImage(imageShaHex)); os.IsNotExist(err) {
+		i.releaseLayers(imageShaHex, chainIDs)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
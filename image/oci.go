@@ -0,0 +1,336 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fdocker/utils"
+	"fdocker/workdirs"
+	"fmt"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+const (
+	ociLayoutVersion = "1.0.0"
+	/* containerd and docker keep the full name here, the ref.name is the tag */
+	ociImageNameAnnotation = "io.containerd.image.name"
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+)
+
+/* The platform images are selected for when pulling or loading an image index */
+func DefaultPlatform() v1.Platform {
+	return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+/* Parses os/arch[/variant], e.g. linux/arm64/v8 */
+func ParsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return v1.Platform{}, fmt.Errorf("invalid platform %s, expected os/arch[/variant]", s)
+	}
+	platform := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func platformString(platform v1.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if len(platform.Variant) > 0 {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+/* A variant is only compared when one was asked for */
+func matchPlatform(actual v1.Platform, wanted v1.Platform) bool {
+	return actual.OS == wanted.OS && actual.Architecture == wanted.Architecture &&
+		(len(wanted.Variant) == 0 || actual.Variant == wanted.Variant)
+}
+
+/*
+	Writes the images as an OCI image layout: an oci-layout file, an
+	index.json with a manifest per image and tag, and the blobs. Layers are
+	gzipped, the index entries carry the image name like the ones docker
+	and containerd write.
+*/
+func (i Accessor) writeOCILayout(tarWriter *tar.Writer, tmpPath string, imageShaHexes []string, repoTags map[string][]string) error {
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	written := make(map[v1.Hash]bool)
+	for _, imageShaHex := range imageShaHexes {
+		log.Printf("Saving image %s\n", imageShaHex)
+		img := i.assembleImage(imageShaHex, tmpPath)
+		configFile, err := img.ConfigFile()
+		if err != nil {
+			return err
+		}
+		rawConfig, err := img.RawConfigFile()
+		if err != nil {
+			return err
+		}
+		configName, err := img.ConfigName()
+		if err != nil {
+			return err
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			return err
+		}
+		manifest := v1.Manifest{
+			SchemaVersion: 2,
+			MediaType:     types.OCIManifestSchema1,
+			Config: v1.Descriptor{
+				MediaType: types.OCIConfigJSON,
+				Size:      int64(len(rawConfig)),
+				Digest:    configName,
+			},
+		}
+		if err := writeOCIBlob(tarWriter, written, configName, rawConfig); err != nil {
+			return err
+		}
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				return err
+			}
+			size, err := layer.Size()
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, v1.Descriptor{
+				MediaType: types.OCILayer,
+				Size:      size,
+				Digest:    digest,
+			})
+			/* Images share their base layers */
+			if written[digest] {
+				continue
+			}
+			written[digest] = true
+			blob, err := layer.Compressed()
+			if err != nil {
+				return err
+			}
+			err = writeArchiveEntry(tarWriter, ociBlobPath(digest), blob, size)
+			blob.Close()
+			if err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		digest, size, err := v1.SHA256(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if err := writeOCIBlob(tarWriter, written, digest, data); err != nil {
+			return err
+		}
+		desc := v1.Descriptor{
+			MediaType: types.OCIManifestSchema1,
+			Size:      size,
+			Digest:    digest,
+		}
+		if len(configFile.OS) > 0 && len(configFile.Architecture) > 0 {
+			desc.Platform = &v1.Platform{OS: configFile.OS, Architecture: configFile.Architecture}
+		}
+		if len(repoTags[imageShaHex]) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, repoTag := range repoTags[imageShaHex] {
+			ref, err := ParseReference(repoTag)
+			if err != nil {
+				return err
+			}
+			desc.Annotations = map[string]string{
+				ociImageNameAnnotation: ref.String(),
+				ociRefNameAnnotation:   ref.Tag,
+			}
+			index.Manifests = append(index.Manifests, desc)
+		}
+	}
+	layout, err := json.Marshal(map[string]string{"imageLayoutVersion": ociLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveEntry(tarWriter, "oci-layout", bytes.NewReader(layout), int64(len(layout))); err != nil {
+		return err
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeArchiveEntry(tarWriter, "index.json", bytes.NewReader(data), int64(len(data)))
+}
+
+func writeOCIBlob(tarWriter *tar.Writer, written map[v1.Hash]bool, digest v1.Hash, data []byte) error {
+	if written[digest] {
+		return nil
+	}
+	written[digest] = true
+	return writeArchiveEntry(tarWriter, ociBlobPath(digest), bytes.NewReader(data), int64(len(data)))
+}
+
+func ociBlobPath(digest v1.Hash) string {
+	return path.Join("blobs", digest.Algorithm, digest.Hex)
+}
+
+/*
+	Installs the images of an OCI image layout, a directory or a tar archive
+	of one. Image indexes, also nested ones, are resolved to the image for
+	platform. Images are tagged with the name annotated in index.json.
+*/
+func (i Accessor) LoadOCILayout(src string, platform v1.Platform) {
+	dir := src
+	info, err := os.Stat(src)
+	if err != nil {
+		log.Fatalf("Unable to read OCI layout: %v\n", err)
+	}
+	if !info.IsDir() {
+		tmpPath, err := ioutil.TempDir(workdirs.TempPath(), "load-")
+		if err != nil {
+			log.Fatalf("Unable to create temporary directory: %v\n", err)
+		}
+		defer os.RemoveAll(tmpPath)
+		f, err := os.Open(src)
+		if err != nil {
+			log.Fatalf("Unable to read OCI layout: %v\n", err)
+		}
+		err = extractArchive(f, tmpPath)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Unable to read archive: %v\n", err)
+		}
+		dir = tmpPath
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "index.json"))
+	if err != nil {
+		log.Fatalf("Unable to read OCI layout: %v\n", err)
+	}
+	index, err := v1.ParseIndexManifest(bytes.NewReader(data))
+	if err != nil {
+		log.Fatalf("Unable to parse index.json: %v\n", err)
+	}
+
+	var manifests []*Manifest
+	var digests [][]string
+	var refs [][]Reference
+	for _, desc := range index.Manifests {
+		manifestDesc := selectOCIManifest(dir, desc, platform)
+		if manifestDesc == nil {
+			log.Printf("Skipping %s, it has no image for %s\n", desc.Digest, platformString(platform))
+			continue
+		}
+		mani, layerDigests := parseOCIManifest(dir, *manifestDesc)
+		if name := ociImageName(desc); len(name) > 0 {
+			mani.RepoTags = []string{name}
+		}
+		manifests = append(manifests, mani)
+		digests = append(digests, layerDigests)
+		/* Check all tags before anything is installed */
+		refs = append(refs, parseRepoTags(mani))
+	}
+	if len(manifests) == 0 {
+		log.Fatalf("The OCI layout has no image for %s\n", platformString(platform))
+	}
+	for n, mani := range manifests {
+		i.loadImage(dir, mani, digests[n], refs[n])
+	}
+}
+
+/* Resolves desc to the descriptor of an image manifest for platform, or nil */
+func selectOCIManifest(dir string, desc v1.Descriptor, platform v1.Platform) *v1.Descriptor {
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		index, err := v1.ParseIndexManifest(bytes.NewReader(readOCIBlob(dir, desc)))
+		if err != nil {
+			log.Fatalf("Unable to parse image index %s: %v\n", desc.Digest, err)
+		}
+		for _, child := range index.Manifests {
+			if manifestDesc := selectOCIManifest(dir, child, platform); manifestDesc != nil {
+				return manifestDesc
+			}
+		}
+		return nil
+	case types.OCIManifestSchema1, types.DockerManifestSchema2:
+		if desc.Platform != nil && !matchPlatform(*desc.Platform, platform) {
+			return nil
+		}
+		return &desc
+	}
+	log.Fatalf("Unsupported media type %s of %s\n", desc.MediaType, desc.Digest)
+	return nil
+}
+
+/*
+	Turns an image manifest into an entry like the ones of the manifest.json
+	of docker archives, with paths relative to the layout. Returns it with
+	the digests of the layers.
+*/
+func parseOCIManifest(dir string, desc v1.Descriptor) (*Manifest, []string) {
+	manifest, err := v1.ParseManifest(bytes.NewReader(readOCIBlob(dir, desc)))
+	if err != nil {
+		log.Fatalf("Unable to parse manifest %s: %v\n", desc.Digest, err)
+	}
+	switch manifest.Config.MediaType {
+	case types.OCIConfigJSON, types.DockerConfigJSON:
+	default:
+		log.Fatalf("Manifest %s is not an image, its config is a %s\n", desc.Digest, manifest.Config.MediaType)
+	}
+	readOCIBlob(dir, manifest.Config)
+	mani := &Manifest{Config: ociBlobPath(manifest.Config.Digest)}
+	var digests []string
+	for _, layer := range manifest.Layers {
+		/* extractLayer tells gzipped and uncompressed tars apart by itself */
+		switch layer.MediaType {
+		case types.OCILayer, types.OCIUncompressedLayer, types.OCIRestrictedLayer, types.OCIUncompressedRestrictedLayer,
+			types.DockerLayer, types.DockerUncompressedLayer, types.DockerForeignLayer:
+		default:
+			log.Fatalf("Unsupported layer media type %s of %s\n", layer.MediaType, layer.Digest)
+		}
+		mani.Layers = append(mani.Layers, ociBlobPath(layer.Digest))
+		digests = append(digests, layer.Digest.String())
+	}
+	return mani, digests
+}
+
+/* Reads a blob of the layout and checks its digest */
+func readOCIBlob(dir string, desc v1.Descriptor) []byte {
+	blobPath, err := utils.ResolvePathInRoot(dir, ociBlobPath(desc.Digest))
+	if err != nil {
+		log.Fatalf("Invalid blob %s: %v\n", desc.Digest, err)
+	}
+	data, err := ioutil.ReadFile(blobPath)
+	if err != nil {
+		log.Fatalf("Unable to read blob %s: %v\n", desc.Digest, err)
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(data))
+	if err != nil || digest != desc.Digest {
+		log.Fatalf("Blob %s is corrupt, its digest is %s\n", desc.Digest, digest)
+	}
+	return data
+}
+
+/*
+	The ref.name annotation is often only the tag, without a repository it
+	can not name an image.
+*/
+func ociImageName(desc v1.Descriptor) string {
+	if name := desc.Annotations[ociImageNameAnnotation]; len(name) > 0 {
+		return name
+	}
+	if name := desc.Annotations[ociRefNameAnnotation]; strings.ContainsAny(name, "/:") {
+		return name
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package image
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressBarWidth       = 40
+	progressRedrawInterval = 100 * time.Millisecond
+)
+
+/*
+	Shows the state of every layer of a pull. On a terminal each layer gets a
+	line with a progress bar that is redrawn in place, otherwise a plain line
+	is printed whenever a layer changes its state, so logs stay readable.
+*/
+type pullProgress struct {
+	mu       sync.Mutex
+	out      *os.File
+	tty      bool
+	ids      []string
+	layers   map[string]*layerProgress
+	drawn    int
+	lastDraw time.Time
+}
+
+type layerProgress struct {
+	status  string
+	current int64
+	total   int64
+}
+
+func newPullProgress(out *os.File, ids []string) *pullProgress {
+	_, err := unix.IoctlGetTermios(int(out.Fd()), unix.TCGETS)
+	p := &pullProgress{
+		out:    out,
+		tty:    err == nil,
+		ids:    ids,
+		layers: make(map[string]*layerProgress),
+	}
+	for _, id := range ids {
+		p.layers[id] = &layerProgress{status: "Waiting"}
+	}
+	return p
+}
+
+func (p *pullProgress) setStatus(id string, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layers[id].status = status
+	if p.tty {
+		p.redraw()
+	} else {
+		fmt.Fprintf(p.out, "%s: %s\n", id, status)
+	}
+}
+
+func (p *pullProgress) setTotal(id string, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layers[id].total = total
+}
+
+func (p *pullProgress) add(id string, n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layers[id].current += n
+	if p.tty && time.Since(p.lastDraw) >= progressRedrawInterval {
+		p.redraw()
+	}
+}
+
+/* Draws the final state, the cursor is left below the last line */
+func (p *pullProgress) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		p.redraw()
+	}
+}
+
+func (p *pullProgress) redraw() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA", p.drawn)
+	}
+	for _, id := range p.ids {
+		fmt.Fprintf(p.out, "\x1b[2K%s: %s\n", id, p.layers[id].line())
+	}
+	p.drawn = len(p.ids)
+	p.lastDraw = time.Now()
+}
+
+func (l *layerProgress) line() string {
+	if !strings.HasPrefix(l.status, "Downloading") || l.total <= 0 {
+		return l.status
+	}
+	filled := int(l.current * progressBarWidth / l.total)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("%s [%s] %s/%s", l.status, bar, formatSize(l.current), formatSize(l.total))
+}
+
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1024*1024*1024:
+		return fmt.Sprintf("%.2fGB", float64(bytes)/1024/1024/1024)
+	case bytes >= 1024*1024:
+		return fmt.Sprintf("%.1fMB", float64(bytes)/1024/1024)
+	case bytes >= 1024:
+		return fmt.Sprintf("%.1fkB", float64(bytes)/1024)
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+/* Reports the bytes read through it as progress of a layer */
+type progressReader struct {
+	io.Reader
+	progress *pullProgress
+	id       string
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.progress.add(r.id, int64(n))
+	return n, err
+}
@@ -0,0 +1,367 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fdocker/utils"
+	"fdocker/workdirs"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+const maxConcurrentDownloads = 3
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+/*
+	Pulls ref from its registry. Images whose config is installed already
+	only get the new tag and digest recorded, otherwise the missing layers
+	are downloaded concurrently and extracted into the layer store while
+	they are downloaded. Returns the image ID.
+*/
+func (i Accessor) PullImage(ref Reference) string {
+	log.Printf("Downloading metadata for %s, please wait...", ref)
+	nameRef, err := name.ParseReference(ref.String(), i.nameOptions()...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	desc, err := remote.Get(nameRef, remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithPlatform(DefaultPlatform()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	/* An image index is resolved to the image for the platform of the host */
+	img, err := desc.Image()
+	if err != nil {
+		log.Fatal(err)
+	}
+	/*
+		Remember the digest of a tag as well so it can be run pinned later.
+		For a multi-platform image that is the digest of the index, the
+		manifest of the platform is recorded as well.
+	*/
+	if len(ref.Digest) == 0 {
+		ref.Digest = desc.Digest.String()
+	}
+	manifestDigest, err := img.Digest()
+	if err != nil {
+		log.Fatalf("Unable to get manifest digest: %v\n", err)
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		log.Fatalf("Unable to get image config digest: %v\n", err)
+	}
+	imageShaHex := configName.Hex[:12]
+	log.Printf("imageHash: %v\n", imageShaHex)
+	/* Identify cases where ubuntu:latest could be the same as ubuntu:20.04*/
+	if altImgName, altImgTag := i.imageExistsByHash(imageShaHex); len(altImgName) > 0 {
+		log.Printf("The image you requested %s is the same as %s:%s\n",
+			ref, FamiliarName(altImgName), altImgTag)
+	} else {
+		i.installImage(img, configName, ref)
+		log.Printf("Successfully downloaded %s\n", ref)
+	}
+	i.storeImageMetadata(ref, imageShaHex)
+	if manifestDigest.String() != ref.Digest {
+		i.storeImageMetadata(Reference{Domain: ref.Domain, Path: ref.Path, Digest: manifestDigest.String()}, imageShaHex)
+	}
+	return imageShaHex
+}
+
+/* Pulls every tag of the repository of ref */
+func (i Accessor) PullAllTags(ref Reference) {
+	tags, err := crane.ListTags(ref.Repository(), i.craneOptions()...)
+	if err != nil {
+		log.Fatalf("Unable to list tags of %s: %v\n", ref.Repository(), err)
+	}
+	for _, tag := range tags {
+		i.PullImage(Reference{Domain: ref.Domain, Path: ref.Path, Tag: tag})
+	}
+}
+
+func (i Accessor) installImage(img v1.Image, configName v1.Hash, ref Reference) {
+	imageShaHex := configName.Hex[:12]
+	configFile, err := img.ConfigFile()
+	if err != nil {
+		log.Fatalf("Unable to get image config: %v\n", err)
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		log.Fatalf("Unable to get image config: %v\n", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		log.Fatalf("Unable to get image layers: %v\n", err)
+	}
+	if len(layers) != len(configFile.RootFS.DiffIDs) {
+		log.Fatalf("Image has %d layers but %d diff IDs\n", len(layers), len(configFile.RootFS.DiffIDs))
+	}
+	var digests, diffIDs, ids []string
+	for n, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			log.Fatalf("Unable to get layer digest: %v\n", err)
+		}
+		digests = append(digests, digest.String())
+		diffIDs = append(diffIDs, configFile.RootFS.DiffIDs[n].String())
+		ids = append(ids, digest.Hex[:12])
+	}
+	chainIDs := ChainIDs(diffIDs)
+
+	/* Referenced up front, so a failed install can tell the layers only it needed */
+	i.addLayerReferences(imageShaHex, chainIDs)
+	progress := newPullProgress(os.Stderr, ids)
+	repository := ref.Repository()
+	slots := make(chan struct{}, maxConcurrentDownloads)
+	errs := make([]error, len(layers))
+	var wg sync.WaitGroup
+	for n, layer := range layers {
+		if i.layerExists(chainIDs[n]) {
+			progress.setStatus(ids[n], "Already exists")
+			continue
+		}
+		wg.Add(1)
+		go func(n int, layer v1.Layer) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			errs[n] = i.fetchLayer(repository, layer, chainIDs[n], progress, ids[n])
+		}(n, layer)
+	}
+	wg.Wait()
+	progress.done()
+	for n, err := range errs {
+		if err != nil {
+			i.abandonImage(imageShaHex, chainIDs)
+			log.Fatalf("Unable to pull layer %s: %v\n", digests[n], err)
+		}
+	}
+
+	err = i.publishImage(imageShaHex, func(dir string) error {
+		if err := ioutil.WriteFile(path.Join(dir, imageShaHex+".json"), rawConfig, 0644); err != nil {
+			return err
+		}
+		var repoTags []string
+		if len(ref.Tag) > 0 {
+			repoTags = []string{FamiliarName(ref.Repository()) + ":" + ref.Tag}
+		}
+		return writeManifest(dir, configName.Hex+".json", repoTags, diffIDs)
+	})
+	if err != nil {
+		log.Fatalf("Unable to save image %s: %v\n", imageShaHex, err)
+	}
+}
+
+/*
+	Creates the directory of an image the same way layers are installed:
+	write fills a staging directory that is renamed to images/<image-id>
+	afterwards. The layers have to be installed and referenced before.
+*/
+func (i Accessor) publishImage(imageShaHex string, write func(dir string) error) error {
+	stagingPath := path.Join(workdirs.TempPath(), "images", imageShaHex)
+	unlock, err := lockPath(stagingPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(i.GetBasePathForImage(imageShaHex)); err == nil {
+		return nil
+	}
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagingPath, 0755); err != nil {
+		return err
+	}
+	if err := write(stagingPath); err != nil {
+		os.RemoveAll(stagingPath)
+		return err
+	}
+	if err := os.Rename(stagingPath, i.GetBasePathForImage(imageShaHex)); err != nil {
+		return err
+	}
+	return os.Remove(stagingPath + ".lock")
+}
+
+/*
+	Streams a layer blob from the registry into the layer store, gunzipping
+	it on the way unless it is an uncompressed tar. The blob is also kept in
+	tmp/blobs until the layer is installed, a retry after an interrupted
+	pull extracts the part that is already there and only downloads the
+	rest.
+*/
+func (i Accessor) fetchLayer(repository string, layer v1.Layer, chainID string, progress *pullProgress, id string) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+	progress.setTotal(id, size)
+	partialPath := path.Join(workdirs.TempPath(), "blobs", digest.Hex+".partial")
+	/* Layers with different chain IDs can share a blob, and with it the partial download */
+	unlock, err := lockPath(partialPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	download := &downloadReader{}
+	err = i.installLayer(chainID, func(dir string) error {
+		partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer partial.Close()
+		offset, err := partial.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if offset > size {
+			offset = 0
+		}
+		body := ioutil.NopCloser(bytes.NewReader(nil))
+		if offset < size {
+			if body, offset, err = i.openBlob(repository, digest, offset); err != nil {
+				return err
+			}
+		}
+		defer body.Close()
+		download.Reader = &progressReader{Reader: body, progress: progress, id: id}
+		if err := partial.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		progress.add(id, offset)
+		if offset > 0 {
+			progress.setStatus(id, "Downloading (resumed)")
+		} else {
+			progress.setStatus(id, "Downloading")
+		}
+		blob := io.MultiReader(io.NewSectionReader(partial, 0, offset),
+			io.TeeReader(download, partial))
+		return extractLayer(blob, dir, digest.String(), diffID.String())
+	})
+	if err != nil {
+		/* Only an interrupted download is worth resuming, not a corrupt blob */
+		if download.Reader != nil && download.err == nil {
+			os.Remove(partialPath)
+		}
+		return err
+	}
+	progress.setStatus(id, "Pull complete")
+	if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(partialPath + ".lock")
+}
+
+/*
+	Extracts a layer blob into the fs directory below layerDir, keeps the
+	blob itself next to it and checks both on the way: digest is the sha256
+	of the blob as it is stored in a registry, diffID the one of the
+	uncompressed tar. An empty digest is not checked, uncompressed layers of
+	docker archives only come with their diffID.
+*/
+func extractLayer(blob io.Reader, layerDir string, digest string, diffID string) error {
+	blobFile, err := os.Create(layerBlobPath(layerDir))
+	if err != nil {
+		return err
+	}
+	defer blobFile.Close()
+	blobHash := sha256.New()
+	reader := bufio.NewReader(io.TeeReader(blob, io.MultiWriter(blobHash, blobFile)))
+	var uncompressed io.Reader = reader
+	if magic, _ := reader.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		uncompressed = gzipReader
+	}
+	tarHash := sha256.New()
+	tarReader := io.TeeReader(uncompressed, tarHash)
+	err = utils.ExtractTar(tarReader, inLayer(path.Join(layerDir, "fs")))
+	if err == nil {
+		/* The tar stream ends before the padding, which is part of the digests */
+		_, err = io.Copy(ioutil.Discard, tarReader)
+	}
+	if _, copyErr := io.Copy(ioutil.Discard, reader); copyErr != nil {
+		return copyErr
+	}
+	/* A corrupt blob usually breaks the extraction, report it as what it is */
+	if actual := "sha256:" + hex.EncodeToString(blobHash.Sum(nil)); len(digest) > 0 && actual != digest {
+		return fmt.Errorf("digest mismatch, expected %s but got %s", digest, actual)
+	}
+	if err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(tarHash.Sum(nil)); actual != diffID {
+		return fmt.Errorf("diffID mismatch, expected %s but got %s", diffID, actual)
+	}
+	return nil
+}
+
+/* Remembers whether reading the download failed, e.g. on a lost connection */
+type downloadReader struct {
+	io.Reader
+	err error
+}
+
+func (r *downloadReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+/* Resolves tar entries inside the layer without following their last component */
+func inLayer(root string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		parent, err := utils.ResolvePathInRoot(root, filepath.Dir(name))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(parent, filepath.Base(name)), nil
+	}
+}
+
+/*
+	Saves a manifest.json in the format of docker save archives next to the
+	config, listing the layers by their diffIDs.
+*/
+func writeManifest(dir string, config string, repoTags []string, diffIDs []string) error {
+	mani := Manifest{Config: config, RepoTags: repoTags}
+	for _, diffID := range diffIDs {
+		mani.Layers = append(mani.Layers, path.Join(diffID[len("sha256:"):], "layer.tar"))
+	}
+	data, err := json.Marshal([]Manifest{mani})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, "manifest.json"), data, 0644)
+}
@@ -0,0 +1,212 @@
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fdocker/utils"
+	"fdocker/workdirs"
+	"fmt"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+/*
+	Uploads an installed image to the registry of ref. Layers the registry
+	has already are not uploaded again. Returns the digest of the pushed
+	manifest.
+*/
+func (i Accessor) PushImage(imageShaHex string, ref Reference) string {
+	tmpPath, err := ioutil.TempDir(workdirs.TempPath(), "push-"+imageShaHex)
+	if err != nil {
+		log.Fatalf("Unable to create temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(tmpPath)
+	img := i.assembleImage(imageShaHex, tmpPath)
+	layers, err := img.Layers()
+	if err != nil {
+		log.Fatalf("Unable to get image layers: %v\n", err)
+	}
+
+	repository := ref.Repository()
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			log.Fatalf("Unable to archive layer: %v\n", err)
+		}
+		if exists, err := i.blobExists(repository, digest); err == nil && exists {
+			fmt.Fprintf(os.Stderr, "%s: Layer already exists\n", digest.Hex[:12])
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: Pushing\n", digest.Hex[:12])
+		}
+	}
+	if err := crane.Push(img, ref.String(), i.craneOptions()...); err != nil {
+		log.Fatalf("Unable to push %s: %v\n", ref, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		log.Fatalf("Unable to get manifest digest: %v\n", err)
+	}
+	return digest.String()
+}
+
+/*
+	Builds a v1.Image of an installed image from its original config and
+	the layer blobs kept in the store, so it keeps its diffIDs and image ID.
+	Images with layers installed before the blobs were kept are rebuilt
+	from the extracted layers below tmpPath instead.
+*/
+func (i Accessor) assembleImage(imageShaHex string, tmpPath string) v1.Image {
+	rawConfig, err := ioutil.ReadFile(i.GetConfigPathForImage(imageShaHex))
+	if err != nil {
+		log.Fatalf("Could not read image config file: %v\n", err)
+	}
+	var layers []v1.Layer
+	for _, chainID := range i.GetLayerChainIDsForImage(imageShaHex) {
+		blobPath := layerBlobPath(path.Dir(i.GetLayerPath(chainID)))
+		if _, err := os.Stat(blobPath); err != nil {
+			return i.rebuildImage(imageShaHex, rawConfig, tmpPath)
+		}
+		layer, err := tarball.LayerFromFile(blobPath)
+		if err != nil {
+			log.Fatalf("Unable to read layer %s: %v\n", chainID, err)
+		}
+		layers = append(layers, layer)
+	}
+	img, err := partial.CompressedToImage(storedImage{rawConfig: rawConfig, layers: layers})
+	if err != nil {
+		log.Fatalf("Unable to assemble image %s: %v\n", imageShaHex, err)
+	}
+	return img
+}
+
+/* An installed image as the raw config and layer blobs it was pulled with */
+type storedImage struct {
+	rawConfig []byte
+	layers    []v1.Layer
+}
+
+func (s storedImage) RawConfigFile() ([]byte, error) {
+	return s.rawConfig, nil
+}
+
+func (s storedImage) MediaType() (types.MediaType, error) {
+	return types.DockerManifestSchema2, nil
+}
+
+func (s storedImage) RawManifest() ([]byte, error) {
+	configName, _, err := v1.SHA256(bytes.NewReader(s.rawConfig))
+	if err != nil {
+		return nil, err
+	}
+	manifest := v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.DockerManifestSchema2,
+		Config: v1.Descriptor{
+			MediaType: types.DockerConfigJSON,
+			Size:      int64(len(s.rawConfig)),
+			Digest:    configName,
+		},
+	}
+	for _, layer := range s.layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{
+			MediaType: types.DockerLayer,
+			Size:      size,
+			Digest:    digest,
+		})
+	}
+	return json.Marshal(manifest)
+}
+
+func (s storedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, layer := range s.layers {
+		if digest, err := layer.Digest(); err == nil && digest == h {
+			return layer, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown layer %s", h)
+}
+
+/*
+	Archives the extracted layers again below tmpPath, which gives them new
+	digests and diffIDs, and updates the config to match, so the image gets
+	a new ID.
+*/
+func (i Accessor) rebuildImage(imageShaHex string, rawConfig []byte, tmpPath string) v1.Image {
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		log.Fatalf("Unable to parse image config data: %v\n", err)
+	}
+	log.Printf("Layers of image %s were installed without their blobs, archiving them again\n", imageShaHex)
+	var layers []v1.Layer
+	for _, tarPath := range i.archiveLayers(imageShaHex, tmpPath) {
+		layer, err := tarball.LayerFromFile(tarPath)
+		if err != nil {
+			log.Fatalf("Unable to archive layer %s: %v\n", tarPath, err)
+		}
+		layers = append(layers, layer)
+	}
+	history := configFile.History
+	configFile.RootFS.DiffIDs, configFile.History = nil, nil
+	img, err := mutate.ConfigFile(empty.Image, configFile)
+	if err == nil {
+		img, err = mutate.AppendLayers(img, layers...)
+	}
+	if err == nil {
+		/* AppendLayers adds an empty history entry per layer */
+		configFile, err = img.ConfigFile()
+	}
+	if err == nil {
+		configFile.History = history
+		img, err = mutate.ConfigFile(img, configFile)
+	}
+	if err != nil {
+		log.Fatalf("Unable to assemble image %s: %v\n", imageShaHex, err)
+	}
+	return img
+}
+
+/*
+	Writes every layer of the image to a tar file below tmpPath named by its
+	chain ID, base layer first. Layers archived for another image before are
+	reused.
+*/
+func (i Accessor) archiveLayers(imageShaHex string, tmpPath string) []string {
+	var tarPaths []string
+	chainIDs := i.GetLayerChainIDsForImage(imageShaHex)
+	layerPaths := i.GetLayerPathsForImage(imageShaHex)
+	for n := len(layerPaths) - 1; n >= 0; n-- {
+		chainID := chainIDs[len(tarPaths)]
+		tarPath := path.Join(tmpPath, chainID[len("sha256:"):]+".tar")
+		tarPaths = append(tarPaths, tarPath)
+		if _, err := os.Stat(tarPath); err == nil {
+			continue
+		}
+		f, err := os.Create(tarPath)
+		if err != nil {
+			log.Fatalf("Unable to archive layer: %v\n", err)
+		}
+		err = utils.WriteTar(f, layerPaths[n], "")
+		f.Close()
+		if err != nil {
+			log.Fatalf("Unable to archive layer %s: %v\n", layerPaths[n], err)
+		}
+	}
+	return tarPaths
+}
@@ -0,0 +1,216 @@
+package image
+
+import (
+	"context"
+	"fdocker/registry"
+	"fdocker/workdirs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/* Moves the image store into a temporary directory for the test */
+func newTestStore(t *testing.T) {
+	workdirs.SetHomePath(t.TempDir())
+	t.Cleanup(func() { workdirs.SetHomePath(workdirs.FDHomePath) })
+	for _, dir := range []string{workdirs.ImagesPath(), workdirs.LayersPath(), workdirs.TempPath()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/* A registry served by fdocker/registry that remembers the Range headers of blob requests */
+type testRegistry struct {
+	server *httptest.Server
+	host   string
+	lock   sync.Mutex
+	ranges map[string]string
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	r, err := registry.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &testRegistry{ranges: make(map[string]string)}
+	reg.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rangeHeader := req.Header.Get("Range"); len(rangeHeader) > 0 {
+			reg.lock.Lock()
+			reg.ranges[path.Base(req.URL.Path)] = rangeHeader
+			reg.lock.Unlock()
+		}
+		r.ServeHTTP(w, req)
+	}))
+	t.Cleanup(reg.server.Close)
+	reg.host = strings.TrimPrefix(reg.server.URL, "http://")
+	return reg
+}
+
+/* Uploads a random image with go-containerregistry, so pulls start from a known manifest */
+func (reg *testRegistry) writeImage(t *testing.T, repository string, layers int) v1.Image {
+	t.Helper()
+	img, err := random.Image(4096, int64(layers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := name.ParseReference(reg.host + "/" + repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func (reg *testRegistry) readImage(t *testing.T, repository string) v1.Image {
+	t.Helper()
+	ref, err := name.ParseReference(reg.host + "/" + repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func mustParseReference(t *testing.T, ref string) Reference {
+	t.Helper()
+	parsed, err := ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestPushKeepsImageID(t *testing.T) {
+	newTestStore(t)
+	reg := newTestRegistry(t)
+	img := reg.writeImage(t, "team/app:1.2", 3)
+	accessor := GetAccessor()
+	imageShaHex := accessor.PullImage(mustParseReference(t, reg.host+"/team/app:1.2"))
+	configName, _ := img.ConfigName()
+	if imageShaHex != configName.Hex[:12] {
+		t.Fatalf("expected image ID %s, got %s", configName.Hex[:12], imageShaHex)
+	}
+
+	digest := accessor.PushImage(imageShaHex, mustParseReference(t, reg.host+"/team/copy:1.2"))
+	expected, _ := img.Digest()
+	if digest != expected.String() {
+		t.Fatalf("expected the pushed manifest %s, got %s", expected, digest)
+	}
+	pushed := reg.readImage(t, "team/copy:1.2")
+	if actual, err := pushed.ConfigName(); err != nil || actual != configName {
+		t.Fatalf("expected config %s, got %s (%v)", configName, actual, err)
+	}
+}
+
+func TestPushRebuildsLayersWithoutBlobs(t *testing.T) {
+	newTestStore(t)
+	reg := newTestRegistry(t)
+	reg.writeImage(t, "team/app:1.2", 2)
+	accessor := GetAccessor()
+	imageShaHex := accessor.PullImage(mustParseReference(t, reg.host+"/team/app:1.2"))
+	/* As left behind by installs before the blobs were kept */
+	for _, chainID := range accessor.GetLayerChainIDsForImage(imageShaHex) {
+		if err := os.Remove(layerBlobPath(path.Dir(accessor.GetLayerPath(chainID)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accessor.PushImage(imageShaHex, mustParseReference(t, reg.host+"/team/copy:1.2"))
+	pushed := reg.readImage(t, "team/copy:1.2")
+	layers, err := pushed.Layers()
+	if err != nil || len(layers) != 2 {
+		t.Fatalf("expected 2 layers, got %d (%v)", len(layers), err)
+	}
+	configFile, err := pushed.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, layer := range layers {
+		if diffID, err := layer.DiffID(); err != nil || diffID != configFile.RootFS.DiffIDs[n] {
+			t.Errorf("layer %d: diffID %s does not match the config (%v)", n, diffID, err)
+		}
+	}
+}
+
+func TestPullResumesPartialDownload(t *testing.T) {
+	newTestStore(t)
+	reg := newTestRegistry(t)
+	img := reg.writeImage(t, "team/app:1.2", 1)
+	layers, _ := img.Layers()
+	digest, _ := layers[0].Digest()
+	compressed, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := ioutil.ReadAll(compressed)
+	compressed.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* As left behind by a pull that was interrupted halfway */
+	partialPath := path.Join(workdirs.TempPath(), "blobs", digest.Hex+".partial")
+	if err := os.MkdirAll(path.Dir(partialPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(partialPath, blob[:len(blob)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	accessor := GetAccessor()
+	imageShaHex := accessor.PullImage(mustParseReference(t, reg.host+"/team/app:1.2"))
+	expectedRange := "bytes=" + strconv.Itoa(len(blob)/2) + "-"
+	if actual := reg.ranges[digest.String()]; actual != expectedRange {
+		t.Errorf("expected the download to resume with %q, got %q", expectedRange, actual)
+	}
+	if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+		t.Errorf("the partial download was not removed: %v", err)
+	}
+	if problems := accessor.VerifyImage(imageShaHex); len(problems) > 0 {
+		t.Errorf("the resumed layer does not match its checksums: %v", problems)
+	}
+	stored, err := ioutil.ReadFile(layerBlobPath(path.Dir(accessor.GetLayerPath(accessor.GetLayerChainIDsForImage(imageShaHex)[0]))))
+	if err != nil || string(stored) != string(blob) {
+		t.Errorf("the stored blob differs from the pulled one (%v)", err)
+	}
+}
+
+func TestInsecureRegistry(t *testing.T) {
+	newTestStore(t)
+	reg := newTestRegistry(t)
+	reg.writeImage(t, "team/app:1.2", 1)
+	/* Every host resolves to the test registry, which only speaks plain HTTP */
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, reg.host)
+		},
+	}
+	t.Cleanup(func() { http.DefaultTransport = defaultTransport })
+
+	accessor := Accessor{Insecure: true}
+	imageShaHex := accessor.PullImage(mustParseReference(t, "registry.example.com/team/app:1.2"))
+	accessor.PushImage(imageShaHex, mustParseReference(t, "registry.example.com/team/copy:1.2"))
+	reg.readImage(t, "team/copy:1.2")
+	/* Without the option the registry is expected to speak HTTPS */
+	repo, err := name.NewRepository("registry.example.com/team/app", GetAccessor().nameOptions()...)
+	if err != nil || repo.Registry.Scheme() != "https" {
+		t.Fatalf("expected https for a public registry, got %s (%v)", repo.Registry.Scheme(), err)
+	}
+}
@@ -0,0 +1,114 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultDomain    = "docker.io"
+	legacyDomain     = "index.docker.io"
+	officialRepoPath = "library/"
+	defaultTag       = "latest"
+)
+
+var (
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	domainRegexp        = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?))*(?::[0-9]+)?$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp        = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+/*
+	Reference is a parsed image reference such as
+		alpine
+		localhost:5000/team/app:1.2
+		ubuntu@sha256:<hex>
+	Domain and Path are normalized the way docker does it: images without a
+	registry host are on docker.io, and official images there live below
+	library/. Tag is "latest" unless a tag or a digest was given.
+*/
+type Reference struct {
+	Domain string
+	Path   string
+	Tag    string
+	Digest string
+}
+
+/*
+	The first component of a name is a registry host if it contains a "."
+	or a ":" or is localhost, otherwise it is part of the repository path
+	on docker.io.
+*/
+func ParseReference(ref string) (Reference, error) {
+	parsed := Reference{}
+	remainder := ref
+	if i := strings.Index(remainder, "@"); i >= 0 {
+		parsed.Digest = remainder[i+1:]
+		remainder = remainder[:i]
+		if !digestRegexp.MatchString(parsed.Digest) {
+			return parsed, fmt.Errorf("invalid digest in image reference %s", ref)
+		}
+	}
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		parsed.Tag = remainder[i+1:]
+		remainder = remainder[:i]
+		if !tagRegexp.MatchString(parsed.Tag) {
+			return parsed, fmt.Errorf("invalid tag in image reference %s", ref)
+		}
+	}
+	parts := strings.SplitN(remainder, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		parsed.Domain, parsed.Path = parts[0], parts[1]
+		if !domainRegexp.MatchString(parsed.Domain) {
+			return parsed, fmt.Errorf("invalid registry host in image reference %s", ref)
+		}
+	} else {
+		parsed.Domain, parsed.Path = defaultDomain, remainder
+	}
+	if parsed.Domain == legacyDomain {
+		parsed.Domain = defaultDomain
+	}
+	if parsed.Domain == defaultDomain && !strings.Contains(parsed.Path, "/") {
+		parsed.Path = officialRepoPath + parsed.Path
+	}
+	for _, component := range strings.Split(parsed.Path, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return parsed, fmt.Errorf("invalid repository name in image reference %s", ref)
+		}
+	}
+	if len(parsed.Tag) == 0 && len(parsed.Digest) == 0 {
+		parsed.Tag = defaultTag
+	}
+	return parsed, nil
+}
+
+/* Returns the normalized repository, e.g. docker.io/library/alpine */
+func (r Reference) Repository() string {
+	return r.Domain + "/" + r.Path
+}
+
+/* Returns the normalized reference, with the digest when there is one */
+func (r Reference) String() string {
+	s := r.Repository()
+	if len(r.Tag) > 0 {
+		s += ":" + r.Tag
+	}
+	if len(r.Digest) > 0 {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+/*
+	Shortens a normalized repository to the form users type, e.g.
+	docker.io/library/alpine to alpine.
+*/
+func FamiliarName(repository string) string {
+	name := strings.TrimPrefix(repository, defaultDomain+"/")
+	if name != repository {
+		name = strings.TrimPrefix(name, officialRepoPath)
+	}
+	return name
+}
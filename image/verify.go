@@ -0,0 +1,155 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+/*
+	FileChecksum describes an entry of an extracted layer. The checksums of
+	all entries are saved next to the fs directory of a layer when it is
+	installed, `image verify` compares the layer against them later.
+*/
+type FileChecksum struct {
+	Path   string      `json:"path"`
+	Mode   os.FileMode `json:"mode"`
+	Uid    uint32      `json:"uid"`
+	Gid    uint32      `json:"gid"`
+	Size   int64       `json:"size,omitempty"`
+	Sha256 string      `json:"sha256,omitempty"`
+	Link   string      `json:"link,omitempty"`
+	Rdev   uint64      `json:"rdev,omitempty"`
+}
+
+func checksumsPath(layerDir string) string {
+	return path.Join(layerDir, "checksums.json")
+}
+
+/* Walks the fs directory below layerDir in lexical order */
+func computeChecksums(layerDir string) ([]FileChecksum, error) {
+	var checksums []FileChecksum
+	root := path.Join(layerDir, "fs")
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		checksum := FileChecksum{Path: "/" + rel, Mode: info.Mode()}
+		if p == root {
+			checksum.Path = "/"
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			checksum.Uid, checksum.Gid = stat.Uid, stat.Gid
+			if info.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0 {
+				checksum.Rdev = stat.Rdev
+			}
+		}
+		switch {
+		case info.Mode().IsRegular():
+			checksum.Size = info.Size()
+			if checksum.Sha256, err = fileSha256(p); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			if checksum.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		checksums = append(checksums, checksum)
+		return nil
+	})
+	return checksums, err
+}
+
+func fileSha256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeChecksums(layerDir string) error {
+	checksums, err := computeChecksums(layerDir)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(checksumsPath(layerDir), data, 0644)
+}
+
+/*
+	Compares the extracted layers of an image against the checksums saved
+	when they were installed. Returns one error per layer that could not be
+	checked and per entry that was added, removed or changed since.
+*/
+func (i Accessor) VerifyImage(imageShaHex string) []error {
+	var problems []error
+	for _, chainID := range i.GetLayerChainIDsForImage(imageShaHex) {
+		layerDir := path.Dir(i.GetLayerPath(chainID))
+		if !i.layerExists(chainID) {
+			problems = append(problems, fmt.Errorf("layer %s: not installed", chainID))
+			continue
+		}
+		data, err := ioutil.ReadFile(checksumsPath(layerDir))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("layer %s: no checksums: %v", chainID, err))
+			continue
+		}
+		var expected []FileChecksum
+		if err := json.Unmarshal(data, &expected); err != nil {
+			problems = append(problems, fmt.Errorf("layer %s: invalid checksums: %v", chainID, err))
+			continue
+		}
+		actual, err := computeChecksums(layerDir)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("layer %s: %v", chainID, err))
+			continue
+		}
+		problems = append(problems, compareChecksums(chainID, expected, actual)...)
+	}
+	return problems
+}
+
+func compareChecksums(chainID string, expected []FileChecksum, actual []FileChecksum) []error {
+	var problems []error
+	found := make(map[string]FileChecksum)
+	for _, checksum := range actual {
+		found[checksum.Path] = checksum
+	}
+	for _, want := range expected {
+		got, ok := found[want.Path]
+		delete(found, want.Path)
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Errorf("layer %s: %s is missing", chainID, want.Path))
+		case got != want:
+			problems = append(problems, fmt.Errorf("layer %s: %s was modified", chainID, want.Path))
+		}
+	}
+	for _, got := range actual {
+		if _, ok := found[got.Path]; ok {
+			problems = append(problems, fmt.Errorf("layer %s: %s was added", chainID, got.Path))
+		}
+	}
+	return problems
+}
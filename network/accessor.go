@@ -205,6 +205,24 @@ func (n Accessor) createIPAddress() string {
 	return fmt.Sprintf("172.31.%d.%d", byte1, byte2)
 }
 
+/*
+	Returns the bytes received and sent by a container. They are read from
+	the host end of its veth pair, which sees the directions swapped, and
+	are only available until the network namespace of the container is gone.
+*/
+func (n Accessor) GetVethStats(containerID string) (uint64, uint64, error) {
+	veth0 := "veth0_" + containerID[:6]
+	link, err := netlink.LinkByName(veth0)
+	if err != nil {
+		return 0, 0, err
+	}
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return 0, 0, fmt.Errorf("no statistics for %s", veth0)
+	}
+	return stats.TxBytes, stats.RxBytes, nil
+}
+
 func (n Accessor) UnmountNetworkNamespace(containerID string) {
 	netNsPath := n.getNetNsPath(containerID)
 	if err := unix.Unmount(netNsPath, 0); err != nil {
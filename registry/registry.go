@@ -0,0 +1,278 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+const maxManifestSize = 4 * 1024 * 1024
+
+const namePattern = `[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*`
+
+var (
+	digestRegexp  = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	tagRegexp     = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	uploadsRoute  = regexp.MustCompile(`^/v2/(` + namePattern + `)/blobs/uploads/?$`)
+	uploadRoute   = regexp.MustCompile(`^/v2/(` + namePattern + `)/blobs/uploads/([a-f0-9]{32})$`)
+	blobRoute     = regexp.MustCompile(`^/v2/(` + namePattern + `)/blobs/(sha256:[a-f0-9]{64})$`)
+	manifestRoute = regexp.MustCompile(`^/v2/(` + namePattern + `)/manifests/([^/]+)$`)
+	tagsRoute     = regexp.MustCompile(`^/v2/(` + namePattern + `)/tags/list$`)
+)
+
+/*
+	Registry serves the OCI distribution API, which docker and
+	go-containerregistry speak, from a directory on disk. There is no
+	authentication, it is meant for trusted networks and tests.
+*/
+type Registry struct {
+	storage storage
+}
+
+func New(root string) (*Registry, error) {
+	r := &Registry{storage: storage{root: root}}
+	return r, r.storage.init()
+}
+
+type registryError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	rw.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if err := r.route(rw, req); err != nil {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(err.status)
+		json.NewEncoder(rw).Encode(map[string][]*registryError{"errors": {err}})
+	}
+	log.Printf("%s %s %d %v\n", req.Method, req.URL.Path, rw.status, time.Since(start))
+}
+
+func (r *Registry) route(w http.ResponseWriter, req *http.Request) *registryError {
+	p := req.URL.Path
+	switch {
+	case p == "/v2" || p == "/v2/":
+		return writeJSON(w, http.StatusOK, struct{}{})
+	case p == "/v2/_catalog":
+		names, err := r.storage.listRepositories()
+		if err != nil {
+			return internalError(err)
+		}
+		return writeJSON(w, http.StatusOK, map[string][]string{"repositories": names})
+	}
+	if m := uploadsRoute.FindStringSubmatch(p); m != nil && req.Method == http.MethodPost {
+		return r.startUpload(w, req, m[1])
+	}
+	if m := uploadRoute.FindStringSubmatch(p); m != nil {
+		return r.handleUpload(w, req, m[1], m[2])
+	}
+	if m := blobRoute.FindStringSubmatch(p); m != nil {
+		return r.handleBlob(w, req, m[2])
+	}
+	if m := manifestRoute.FindStringSubmatch(p); m != nil {
+		return r.handleManifest(w, req, m[1], m[2])
+	}
+	if m := tagsRoute.FindStringSubmatch(p); m != nil && req.Method == http.MethodGet {
+		tags, err := r.storage.listTags(m[1])
+		if os.IsNotExist(err) {
+			return &registryError{http.StatusNotFound, "NAME_UNKNOWN", "repository " + m[1] + " is not known"}
+		} else if err != nil {
+			return internalError(err)
+		}
+		return writeJSON(w, http.StatusOK, map[string]interface{}{"name": m[1], "tags": tags})
+	}
+	return &registryError{http.StatusNotFound, "UNSUPPORTED", req.Method + " " + p + " is not supported"}
+}
+
+func (r *Registry) handleBlob(w http.ResponseWriter, req *http.Request, digest string) *registryError {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return &registryError{http.StatusMethodNotAllowed, "UNSUPPORTED", "blobs can only be read"}
+	}
+	f, err := os.Open(r.storage.blobPath(digest))
+	if os.IsNotExist(err) {
+		return &registryError{http.StatusNotFound, "BLOB_UNKNOWN", "blob " + digest + " is not known"}
+	} else if err != nil {
+		return internalError(err)
+	}
+	defer f.Close()
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	/* Takes care of HEAD and of Range requests, used to resume downloads */
+	http.ServeContent(w, req, "", time.Time{}, f)
+	return nil
+}
+
+/*
+	Starts a blob upload. A digest in the query makes it a monolithic upload
+	of the request body, mount and from ask for a blob the registry has
+	already, which all repositories share here.
+*/
+func (r *Registry) startUpload(w http.ResponseWriter, req *http.Request, name string) *registryError {
+	if digest := req.URL.Query().Get("mount"); digestRegexp.MatchString(digest) && r.storage.blobExists(digest) {
+		return blobCreated(w, name, digest)
+	}
+	id, err := r.storage.startUpload()
+	if err != nil {
+		return internalError(err)
+	}
+	if digest := req.URL.Query().Get("digest"); len(digest) > 0 {
+		return r.finishUpload(w, req, name, id, digest)
+	}
+	return uploadAccepted(w, name, id, 0)
+}
+
+func (r *Registry) handleUpload(w http.ResponseWriter, req *http.Request, name string, id string) *registryError {
+	size, err := r.storage.uploadSize(id)
+	if os.IsNotExist(err) {
+		return &registryError{http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload " + id + " is not known"}
+	} else if err != nil {
+		return internalError(err)
+	}
+	switch req.Method {
+	case http.MethodGet:
+		return uploadAccepted(w, name, id, size)
+	case http.MethodPatch:
+		if size, err = r.storage.appendUpload(id, req.Body); err != nil {
+			return internalError(err)
+		}
+		return uploadAccepted(w, name, id, size)
+	case http.MethodPut:
+		return r.finishUpload(w, req, name, id, req.URL.Query().Get("digest"))
+	case http.MethodDelete:
+		if err := r.storage.cancelUpload(id); err != nil {
+			return internalError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return &registryError{http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method + " is not supported for uploads"}
+}
+
+/* The last chunk of an upload may come with the request that finishes it */
+func (r *Registry) finishUpload(w http.ResponseWriter, req *http.Request, name string, id string, digest string) *registryError {
+	if !digestRegexp.MatchString(digest) {
+		r.storage.cancelUpload(id)
+		return &registryError{http.StatusBadRequest, "DIGEST_INVALID", "invalid digest " + digest}
+	}
+	if _, err := r.storage.appendUpload(id, req.Body); err != nil {
+		return internalError(err)
+	}
+	if err := r.storage.finishUpload(id, digest); err != nil {
+		return &registryError{http.StatusBadRequest, "DIGEST_INVALID", err.Error()}
+	}
+	return blobCreated(w, name, digest)
+}
+
+func (r *Registry) handleManifest(w http.ResponseWriter, req *http.Request, name string, reference string) *registryError {
+	if !digestRegexp.MatchString(reference) && !tagRegexp.MatchString(reference) {
+		return &registryError{http.StatusBadRequest, "TAG_INVALID", "invalid tag " + reference}
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		digest, mediaType, err := r.storage.resolveManifest(name, reference)
+		if os.IsNotExist(err) {
+			return &registryError{http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest " + reference + " is not known"}
+		} else if err != nil {
+			return internalError(err)
+		}
+		data, err := ioutil.ReadFile(r.storage.blobPath(digest))
+		if err != nil {
+			return internalError(err)
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+		return nil
+	case http.MethodPut:
+		data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxManifestSize+1))
+		if err != nil {
+			return internalError(err)
+		}
+		if len(data) > maxManifestSize {
+			return &registryError{http.StatusRequestEntityTooLarge, "MANIFEST_INVALID", "manifest is too large"}
+		}
+		missing, err := r.storage.missingBlob(data)
+		if err != nil {
+			return &registryError{http.StatusBadRequest, "MANIFEST_INVALID", err.Error()}
+		}
+		if len(missing) > 0 {
+			return &registryError{http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob " + missing + " is not known"}
+		}
+		digest, err := r.storage.putManifest(name, reference, req.Header.Get("Content-Type"), data)
+		if err != nil {
+			return &registryError{http.StatusBadRequest, "MANIFEST_INVALID", err.Error()}
+		}
+		w.Header().Set("Location", "/v2/"+name+"/manifests/"+digest)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case http.MethodDelete:
+		err := r.storage.deleteManifest(name, reference)
+		if os.IsNotExist(err) {
+			return &registryError{http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest " + reference + " is not known"}
+		} else if err != nil {
+			return internalError(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	return &registryError{http.StatusMethodNotAllowed, "UNSUPPORTED", req.Method + " is not supported for manifests"}
+}
+
+func uploadAccepted(w http.ResponseWriter, name string, id string, size int64) *registryError {
+	w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+	w.Header().Set("Docker-Upload-UUID", id)
+	if size > 0 {
+		w.Header().Set("Range", fmt.Sprintf("0-%d", size-1))
+	} else {
+		w.Header().Set("Range", "0-0")
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func blobCreated(w http.ResponseWriter, name string, digest string) *registryError {
+	w.Header().Set("Location", "/v2/"+name+"/blobs/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) *registryError {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return internalError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+	return nil
+}
+
+func internalError(err error) *registryError {
+	return &registryError{http.StatusInternalServerError, "UNKNOWN", err.Error()}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,147 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/* Returns the host of a registry serving a fresh temporary directory */
+func newTestRegistry(t *testing.T) string {
+	r, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func parseTestReference(t *testing.T, ref string) name.Reference {
+	t.Helper()
+	parsed, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func readLayer(t *testing.T, layer v1.Layer) []byte {
+	t.Helper()
+	r, err := layer.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPushPullRoundTrip(t *testing.T) {
+	host := newTestRegistry(t)
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := parseTestReference(t, host+"/team/app:1.2")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	pulled, err := remote.Image(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := img.Digest()
+	if actual, err := pulled.Digest(); err != nil || actual != expected {
+		t.Fatalf("expected manifest %s, got %s (%v)", expected, actual, err)
+	}
+	expectedConfig, _ := img.RawConfigFile()
+	if actualConfig, err := pulled.RawConfigFile(); err != nil || !bytes.Equal(actualConfig, expectedConfig) {
+		t.Fatalf("config changed on the way: %v", err)
+	}
+	layers, _ := img.Layers()
+	pulledLayers, err := pulled.Layers()
+	if err != nil || len(pulledLayers) != len(layers) {
+		t.Fatalf("expected %d layers, got %d (%v)", len(layers), len(pulledLayers), err)
+	}
+	for n := range layers {
+		if !bytes.Equal(readLayer(t, pulledLayers[n]), readLayer(t, layers[n])) {
+			t.Errorf("layer %d changed on the way", n)
+		}
+	}
+
+	/* The manifest can also be pulled by its digest */
+	if _, err := remote.Image(parseTestReference(t, host+"/team/app@"+expected.String())); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := remote.List(ref.Context())
+	if err != nil || len(tags) != 1 || tags[0] != "1.2" {
+		t.Fatalf("expected tag 1.2, got %v (%v)", tags, err)
+	}
+}
+
+func TestPushPullIndex(t *testing.T) {
+	host := newTestRegistry(t)
+	index, err := random.Index(1024, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := parseTestReference(t, host+"/team/multi:latest")
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatal(err)
+	}
+	pulled, err := remote.Index(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := index.Digest()
+	if actual, err := pulled.Digest(); err != nil || actual != expected {
+		t.Fatalf("expected index %s, got %s (%v)", expected, actual, err)
+	}
+}
+
+func TestPutManifestRejectsMissingBlobs(t *testing.T) {
+	host := newTestRegistry(t)
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := img.RawManifest()
+	mediaType, _ := img.MediaType()
+	req, err := http.NewRequest(http.MethodPut, "http://"+host+"/v2/team/app/manifests/1.2", bytes.NewReader(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", string(mediaType))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Errors []registryError `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest || len(body.Errors) != 1 || body.Errors[0].Code != "MANIFEST_BLOB_UNKNOWN" {
+		t.Fatalf("expected MANIFEST_BLOB_UNKNOWN, got %d %+v", resp.StatusCode, body.Errors)
+	}
+
+	/* Nothing may be left that a pull could find */
+	if _, err := remote.Image(parseTestReference(t, host+"/team/app:1.2")); err == nil {
+		t.Fatal("a rejected manifest can be pulled")
+	}
+}
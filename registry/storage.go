@@ -0,0 +1,285 @@
+package registry
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+	storage keeps the registry contents below its root directory:
+		blobs/sha256/<hex>				layers, configs and manifests
+		uploads/<id>					blob uploads in progress
+		repositories/<name>/_manifests/<hex>	media type of a manifest of the repository
+		repositories/<name>/_tags/<tag>		digest of the manifest the tag points to
+	Repository path components never start with "_", so these directories
+	can not clash with nested repositories. Blobs are shared by all
+	repositories. Files are written to a temporary file first and renamed,
+	so readers never see partial contents.
+*/
+type storage struct {
+	root string
+}
+
+func (s storage) blobPath(digest string) string {
+	return filepath.Join(s.root, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (s storage) uploadPath(id string) string {
+	return filepath.Join(s.root, "uploads", id)
+}
+
+func (s storage) manifestPath(name string, digest string) string {
+	return filepath.Join(s.root, "repositories", name, "_manifests", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (s storage) tagPath(name string, tag string) string {
+	return filepath.Join(s.root, "repositories", name, "_tags", tag)
+}
+
+func (s storage) init() error {
+	for _, dir := range []string{"blobs/sha256", "uploads", "repositories"} {
+		if err := os.MkdirAll(filepath.Join(s.root, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomic(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s storage) blobExists(digest string) bool {
+	_, err := os.Stat(s.blobPath(digest))
+	return err == nil
+}
+
+func (s storage) putBlob(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	return digest, writeFileAtomic(s.blobPath(digest), data)
+}
+
+func (s storage) startUpload() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(buf)
+	f, err := os.Create(s.uploadPath(id))
+	if err != nil {
+		return "", err
+	}
+	return id, f.Close()
+}
+
+/* Appends r to an upload and returns the size of the upload afterwards */
+func (s storage) appendUpload(id string, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.uploadPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s storage) uploadSize(id string) (int64, error) {
+	info, err := os.Stat(s.uploadPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+/* Moves a finished upload into the blobs if it has the expected digest */
+func (s storage) finishUpload(id string, digest string) error {
+	p := s.uploadPath(id)
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		os.Remove(p)
+		return fmt.Errorf("upload has digest %s, not %s", actual, digest)
+	}
+	return os.Rename(p, s.blobPath(digest))
+}
+
+func (s storage) cancelUpload(id string) error {
+	return os.Remove(s.uploadPath(id))
+}
+
+/* Resolves a tag or digest of a repository to the digest and media type of the manifest */
+func (s storage) resolveManifest(name string, reference string) (string, string, error) {
+	digest := reference
+	if !digestRegexp.MatchString(reference) {
+		data, err := ioutil.ReadFile(s.tagPath(name, reference))
+		if err != nil {
+			return "", "", err
+		}
+		digest = string(data)
+	}
+	mediaType, err := ioutil.ReadFile(s.manifestPath(name, digest))
+	if err != nil {
+		return "", "", err
+	}
+	return digest, string(mediaType), nil
+}
+
+/* The parts of image manifests and indexes that refer to other blobs */
+type manifestReferences struct {
+	Config    *descriptor  `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+type descriptor struct {
+	Digest string   `json:"digest"`
+	URLs   []string `json:"urls"`
+}
+
+/*
+	Returns the first blob a manifest or index refers to that is not
+	stored, or "" if all are there. Foreign layers, which are fetched
+	from their URLs, are never pushed and not checked.
+*/
+func (s storage) missingBlob(data []byte) (string, error) {
+	var refs manifestReferences
+	if err := json.Unmarshal(data, &refs); err != nil {
+		return "", err
+	}
+	descriptors := append(refs.Layers, refs.Manifests...)
+	if refs.Config != nil {
+		descriptors = append([]descriptor{*refs.Config}, descriptors...)
+	}
+	for _, desc := range descriptors {
+		if len(desc.URLs) > 0 {
+			continue
+		}
+		if !digestRegexp.MatchString(desc.Digest) {
+			return "", fmt.Errorf("invalid digest %s", desc.Digest)
+		}
+		if !s.blobExists(desc.Digest) {
+			return desc.Digest, nil
+		}
+	}
+	return "", nil
+}
+
+func (s storage) putManifest(name string, reference string, mediaType string, data []byte) (string, error) {
+	digest, err := s.putBlob(data)
+	if err != nil {
+		return "", err
+	}
+	if digestRegexp.MatchString(reference) && reference != digest {
+		return "", fmt.Errorf("manifest has digest %s, not %s", digest, reference)
+	}
+	if err := writeFileAtomic(s.manifestPath(name, digest), []byte(mediaType)); err != nil {
+		return "", err
+	}
+	if !digestRegexp.MatchString(reference) {
+		if err := writeFileAtomic(s.tagPath(name, reference), []byte(digest)); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+/*
+	Deletes a tag, or a manifest together with the tags pointing to it.
+	The blobs are kept, other repositories may share them.
+*/
+func (s storage) deleteManifest(name string, reference string) error {
+	if !digestRegexp.MatchString(reference) {
+		return os.Remove(s.tagPath(name, reference))
+	}
+	if err := os.Remove(s.manifestPath(name, reference)); err != nil {
+		return err
+	}
+	tags, err := s.listTags(name)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if data, err := ioutil.ReadFile(s.tagPath(name, tag)); err == nil && string(data) == reference {
+			os.Remove(s.tagPath(name, tag))
+		}
+	}
+	return nil
+}
+
+func (s storage) listTags(name string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.root, "repositories", name, "_tags"))
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), ".tmp-") {
+			tags = append(tags, entry.Name())
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+/* Repositories are the directories below repositories/ that have a _manifests directory */
+func (s storage) listRepositories() ([]string, error) {
+	root := filepath.Join(s.root, "repositories")
+	var names []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "_manifests" {
+			name, err := filepath.Rel(root, filepath.Dir(p))
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+/*
+	Converts the error returned by exec.Cmd.Wait into an exit code the way a
+	shell does: a process killed by a signal exits with 128 plus the signal.
+*/
+func ExitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return exitErr.ExitCode(), nil
+}
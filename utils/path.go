@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 func EnsureDirs(dirs []string) error {
@@ -35,3 +38,47 @@ func CopyFile(src, dst string) error {
 	}
 	return nil
 }
+
+/*
+	Resolves unsafePath inside root the way a process chrooted into root would
+	see it: absolute symlinks are interpreted relative to root, while a
+	relative symlink climbing above root is refused instead of followed.
+*/
+func ResolvePathInRoot(root string, unsafePath string) (string, error) {
+	const maxSymlinks = 255
+	current := "/"
+	links := 0
+	pending := strings.Split(filepath.Clean("/"+unsafePath), "/")
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			if current == "/" {
+				return "", fmt.Errorf("path %s escapes %s", unsafePath, root)
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+		next := filepath.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", unsafePath)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			current = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, current), nil
+}
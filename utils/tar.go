@@ -2,10 +2,13 @@ package utils
 
 import (
 	"archive/tar"
+	"fmt"
+	"golang.org/x/sys/unix"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func UnTar(tarball, target string) error {
@@ -83,3 +86,153 @@ func UnTar(tarball, target string) error {
 	}
 	return nil
 }
+
+/*
+	Writes srcPath, and everything below it when it is a directory, to w as a
+	tar stream whose entries are rooted at name. Symlinks are archived as
+	links, ownership and permissions are kept.
+*/
+func WriteTar(w io.Writer, srcPath string, name string) error {
+	tarWriter := tar.NewWriter(w)
+	err := filepath.Walk(srcPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcPath, p)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.Join(name, rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+/*
+	Extracts the tar stream read from r. resolve maps every entry name to the
+	path it is written to, which lets callers confine the extraction to a
+	directory. Unlike UnTar, ownership, permissions, timestamps and special
+	files are restored.
+*/
+func ExtractTar(r io.Reader, resolve func(name string) (string, error)) error {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean(header.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid tar entry: %s", header.Name)
+		}
+		target, err := resolve(name)
+		if err != nil {
+			return err
+		}
+		if err := extractTarEntry(tarReader, header, target, resolve); err != nil {
+			return err
+		}
+	}
+}
+
+func extractTarEntry(tarReader *tar.Reader, header *tar.Header, target string,
+	resolve func(name string) (string, error)) error {
+	mode := header.FileInfo().Mode()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	/* Never write through an existing symlink or file, replace it instead */
+	if info, err := os.Lstat(target); err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode.Perm()); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tarReader)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkTarget, err := resolve(filepath.Clean(header.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(linkTarget, target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(unix.S_IFIFO)
+		if header.Typeflag == tar.TypeChar {
+			devMode = unix.S_IFCHR
+		} else if header.Typeflag == tar.TypeBlock {
+			devMode = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+		if err := unix.Mknod(target, devMode|uint32(mode.Perm()), int(dev)); err != nil {
+			return err
+		}
+	default:
+		log.Printf("Warning: File type %d unhandled by ExtractTar function!\n", header.Typeflag)
+		return nil
+	}
+
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+		return nil
+	}
+	/* chown clears the setuid and setgid bits, so the mode is set afterwards */
+	if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
@@ -2,6 +2,26 @@ package workdirs
 
 import "path"
 
+func GetContainerHome(containerID string) string {
+	return path.Join(ContainersPath(), containerID)
+}
+
 func GetContainerFSHome(containerID string) string {
-	return path.Join(ContainersPath(), containerID, "fs")
+	return path.Join(GetContainerHome(containerID), "fs")
+}
+
+func GetContainerMntPath(containerID string) string {
+	return path.Join(GetContainerFSHome(containerID), "mnt")
+}
+
+func GetContainerUpperDirPath(containerID string) string {
+	return path.Join(GetContainerFSHome(containerID), "upperdir")
+}
+
+func GetContainerWorkDirPath(containerID string) string {
+	return path.Join(GetContainerFSHome(containerID), "workdir")
+}
+
+func GetContainerStatePath(containerID string) string {
+	return path.Join(GetContainerHome(containerID), "state.json")
 }
@@ -1,24 +1,42 @@
 package workdirs
 
-import "fdocker/utils"
+import (
+	"fdocker/utils"
+	"path"
+)
 
 const FDHomePath = "/var/lib/f-docker"
-const FDTempPath = FDHomePath + "/tmp"
-const FDImagesPath = FDHomePath + "/images"
 const FDContainersPath = "/var/run/f-docker/containers"
 const FDNetNsPath = "/var/run/f-docker/net-ns"
+const FDCGroupParentsPath = "/var/run/f-docker/cgroup-parents.json"
+
+/* The images, layers and everything else below FDHomePath live here */
+var homePath = FDHomePath
+
+/* Moves the paths below FDHomePath, tests keep their image store in a temporary directory */
+func SetHomePath(p string) {
+	homePath = p
+}
 
 func Init() error {
-	dirs := []string{FDHomePath, FDTempPath, FDImagesPath, FDContainersPath}
+	dirs := []string{homePath, TempPath(), ImagesPath(), LayersPath(), FDContainersPath}
 	return utils.EnsureDirs(dirs)
 }
 
 func ImagesPath() string {
-	return FDImagesPath
+	return path.Join(homePath, "images")
+}
+
+func LayersPath() string {
+	return path.Join(homePath, "layers")
+}
+
+func RegistryPath() string {
+	return path.Join(homePath, "registry")
 }
 
 func TempPath() string {
-	return FDTempPath
+	return path.Join(homePath, "tmp")
 }
 
 func ContainersPath() string {
@@ -28,3 +46,15 @@ func ContainersPath() string {
 func NetNsPath() string {
 	return FDNetNsPath
 }
+
+func EventsPath() string {
+	return path.Join(homePath, "events.json")
+}
+
+func CGroupParentsPath() string {
+	return FDCGroupParentsPath
+}
+
+func ConfigPath() string {
+	return path.Join(homePath, "config.json")
+}